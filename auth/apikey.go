@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"social-media/database"
+	"social-media/hash"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// APIKeyPrefix starts every API key so it can be told apart from a JWT when
+// both are sent as bearer tokens.
+const APIKeyPrefix = "smk_"
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+type APIKey struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// CreateAPIKey stores a new key for a user. Only a hash is kept, so the
+// returned plain key is the only copy.
+func CreateAPIKey(userId int, name string, scopes []string, expiresAt *time.Time) (string, APIKey, error) {
+	secret, err := hash.RandomToken(32)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	plain := APIKeyPrefix + secret
+	key := APIKey{
+		Name:      name,
+		Prefix:    plain[:len(APIKeyPrefix)+6],
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	err = database.PostgreConn.QueryRow(context.Background(), "insert into api_keys (user_id, name, key_hash, prefix, scopes, expires_at) values ($1, $2, $3, $4, $5, $6) returning id, created_at",
+		userId, name, hash.HashToken(plain), key.Prefix, scopes, expiresAt).Scan(&key.Id, &key.CreatedAt)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	return plain, key, nil
+}
+
+// ListAPIKeys returns the keys of a user that haven't been revoked.
+func ListAPIKeys(userId int) ([]APIKey, error) {
+	rows, err := database.PostgreConn.Query(context.Background(), "select id, name, prefix, scopes, created_at, expires_at, last_used_at from api_keys where user_id=$1 and revoked_at is null order by id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.Id, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes a key of the user. It reports false when the user has
+// no such key.
+func RevokeAPIKey(userId, keyId int) (bool, error) {
+	tag, err := database.PostgreConn.Exec(context.Background(), "update api_keys set revoked_at=now() where id=$1 and user_id=$2 and revoked_at is null", keyId, userId)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// APIKeyPrincipal resolves a plain API key to the caller it belongs to.
+func APIKeyPrincipal(plain string) (*Principal, error) {
+	if !strings.HasPrefix(plain, APIKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+	principal := &Principal{}
+	var keyId int
+	var keyScopes []string
+	err := database.PostgreConn.QueryRow(context.Background(), `select k.id, k.user_id, u.login, k.scopes from api_keys k join users u on u.id = k.user_id
+		where k.key_hash=$1 and k.revoked_at is null and (k.expires_at is null or k.expires_at > now())`, hash.HashToken(plain)).
+		Scan(&keyId, &principal.Id, &principal.Login, &keyScopes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	principal.APIKeyId = keyId
+
+	// A key never grants more than its owner currently has, so demoting a
+	// user also limits the keys they created before.
+	grants, err := LoadGrants(principal.Id)
+	if err != nil {
+		return nil, err
+	}
+	principal.Role = grants.Role
+	for _, scope := range keyScopes {
+		if containsScope(grants.Scopes, scope) {
+			principal.Scopes = append(principal.Scopes, scope)
+		}
+	}
+
+	if _, err := database.PostgreConn.Exec(context.Background(), "update api_keys set last_used_at=now() where id=$1", keyId); err != nil {
+		return nil, err
+	}
+	return principal, nil
+}
@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AccessCookie  = "token"
+	RefreshCookie = "refresh_token"
+)
+
+// SetSessionCookies stores a token pair in cookies. The refresh token is
+// http-only and scoped to the paths that accept it.
+func SetSessionCookies(c *gin.Context, pair TokenPair) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(AccessCookie, pair.AccessToken, int(accessTokenTTL/time.Second), "/", "", false, false)
+	c.SetCookie(RefreshCookie, pair.RefreshToken, int(time.Until(pair.RefreshExpiresAt)/time.Second), "/", "", false, true)
+}
+
+// ClearSessionCookies removes the cookies set by SetSessionCookies.
+func ClearSessionCookies(c *gin.Context) {
+	c.SetCookie(AccessCookie, "", -1, "/", "", false, false)
+	c.SetCookie(RefreshCookie, "", -1, "/", "", false, true)
+}
@@ -2,62 +2,105 @@ package auth
 
 import (
 	"errors"
+	"social-media/hash"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
-var jwtKey = []byte("supersercretkey")
+// accessTokenTTL is kept short so revoked tokens don't linger in the
+// denylist; clients renew them with a refresh token.
+const accessTokenTTL = 15 * time.Minute
 
+var (
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// JWTClaim carries the token id in the standard jti claim and the refresh
+// token family it was issued for in sid, so a single device can be logged out.
+// Role and Scopes are copied from Postgres when the token is issued. The
+// standard iat only has seconds, so the issue time is repeated in
+// microseconds to tell tokens apart from a revocation in the same second.
 type JWTClaim struct {
-	ID    int    `json:"id"`
-	Login string `json:"login"`
+	ID            int      `json:"id"`
+	Login         string   `json:"login"`
+	Session       string   `json:"sid,omitempty"`
+	Role          string   `json:"role"`
+	Scopes        []string `json:"scopes"`
+	IssuedAtMicro int64    `json:"iat_us,omitempty"`
 	jwt.StandardClaims
 }
 
-func GenerateJWT(id int, login string) (tokenString string, err error) {
-	expirationTime := time.Now().Add(1 * time.Hour)
+// issuedAt returns when the token was issued, only to the second for tokens
+// without iat_us.
+func (c *JWTClaim) issuedAt() time.Time {
+	if c.IssuedAtMicro != 0 {
+		return time.UnixMicro(c.IssuedAtMicro)
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
+func GenerateJWT(id int, login, session string, grants Grants) (tokenString string, err error) {
+	jti, err := hash.RandomToken(16)
+	if err != nil {
+		return
+	}
+	now := time.Now()
 	claims := &JWTClaim{
-		ID:    id,
-		Login: login,
+		ID:      id,
+		Login:   login,
+		Session: session,
+		Role:    grants.Role,
+		Scopes:  grants.Scopes,
+		// Postgres keeps revocation times in microseconds as well.
+		IssuedAtMicro: now.UnixMicro(),
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenTTL).Unix(),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err = token.SignedString(jwtKey)
+	token := jwt.NewWithClaims(activeKey.method, claims)
+	token.Header["kid"] = activeKey.id
+	tokenString, err = token.SignedString(activeKey.signKey)
 	return
 }
 
 func ValidateToken(signedToken string) (err error) {
-	claims, err := parseToken(signedToken)
+	_, err = ValidClaims(signedToken)
+	return
+}
+
+// ValidClaims parses a token and returns its claims if the token is neither
+// expired nor revoked.
+func ValidClaims(signedToken string) (claims *JWTClaim, err error) {
+	claims, err = parseToken(signedToken)
 	if err != nil {
 		return
 	}
 	if claims.ExpiresAt < time.Now().Local().Unix() {
-		err = errors.New("token expired")
+		err = ErrTokenExpired
 		return
 	}
-	return
-}
-
-func TokenCredentials(token string) (id int, login string, err error) {
-	claims, err := parseToken(token)
-	if err != nil {
+	if Revoked(claims) {
+		err = ErrTokenRevoked
 		return
 	}
-	return claims.ID, claims.Login, err
+	return
 }
 
 func parseToken(signedToken string) (claims *JWTClaim, err error) {
 	token, err := jwt.ParseWithClaims(
 		signedToken,
 		&JWTClaim{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtKey), nil
-		},
+		lookupKey,
 	)
 	if err != nil {
+		var vErr *jwt.ValidationError
+		if errors.As(err, &vErr) && vErr.Errors == jwt.ValidationErrorExpired {
+			err = ErrTokenExpired
+		}
 		return
 	}
 	claims, ok := token.Claims.(*JWTClaim)
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// KeyConfig describes one signing key as it is written in the config file.
+// HS256 keys take a secret, RS256 and EdDSA keys take PEM files. A key
+// without a private key can only verify tokens.
+type KeyConfig struct {
+	Id             string
+	Algorithm      string
+	Secret         string
+	SecretFile     string
+	PrivateKeyFile string
+	PublicKeyFile  string
+}
+
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// keys holds every key accepted for verification, activeKey is the one new
+// tokens are signed with. Several keys are configured at once while rotating:
+// the new key becomes active and the old one stays until its tokens expire.
+var (
+	keys      = make(map[string]*signingKey)
+	activeKey *signingKey
+)
+
+// InitKeys loads the configured keys. It must be called before any token is
+// issued or parsed.
+func InitKeys(configs []KeyConfig, active string) error {
+	loaded := make(map[string]*signingKey)
+	for _, cfg := range configs {
+		if cfg.Id == "" {
+			return errors.New("jwt key without id")
+		}
+		if _, ok := loaded[cfg.Id]; ok {
+			return fmt.Errorf("jwt key %q is configured twice", cfg.Id)
+		}
+		key, err := loadKey(cfg)
+		if err != nil {
+			return fmt.Errorf("jwt key %q: %w", cfg.Id, err)
+		}
+		loaded[cfg.Id] = key
+	}
+
+	key, ok := loaded[active]
+	if !ok {
+		return fmt.Errorf("active jwt key %q is not configured", active)
+	}
+	if key.signKey == nil {
+		return fmt.Errorf("active jwt key %q has no private key", active)
+	}
+	keys = loaded
+	activeKey = key
+	return nil
+}
+
+func loadKey(cfg KeyConfig) (*signingKey, error) {
+	key := &signingKey{id: cfg.Id}
+	switch cfg.Algorithm {
+	case "HS256":
+		secret := []byte(cfg.Secret)
+		if cfg.SecretFile != "" {
+			data, err := os.ReadFile(cfg.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			secret = data
+		}
+		if len(secret) < 32 {
+			return nil, errors.New("HS256 secret must be at least 32 bytes long")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = secret
+		key.verifyKey = secret
+	case "RS256":
+		key.method = jwt.SigningMethodRS256
+		if cfg.PrivateKeyFile != "" {
+			data, err := os.ReadFile(cfg.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = &privateKey.PublicKey
+		}
+		if cfg.PublicKeyFile != "" {
+			data, err := os.ReadFile(cfg.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			publicKey, err := jwt.ParseRSAPublicKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = publicKey
+		}
+	case "EdDSA":
+		key.method = SigningMethodEdDSA
+		if cfg.PrivateKeyFile != "" {
+			privateKey, err := parsePEMKey(cfg.PrivateKeyFile, x509.ParsePKCS8PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			edKey, ok := privateKey.(ed25519.PrivateKey)
+			if !ok {
+				return nil, errors.New("private key is not an Ed25519 key")
+			}
+			key.signKey = edKey
+			key.verifyKey = edKey.Public()
+		}
+		if cfg.PublicKeyFile != "" {
+			publicKey, err := parsePEMKey(cfg.PublicKeyFile, x509.ParsePKIXPublicKey)
+			if err != nil {
+				return nil, err
+			}
+			edKey, ok := publicKey.(ed25519.PublicKey)
+			if !ok {
+				return nil, errors.New("public key is not an Ed25519 key")
+			}
+			key.verifyKey = edKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", cfg.Algorithm)
+	}
+
+	if key.verifyKey == nil {
+		return nil, errors.New("no key file given")
+	}
+	return key, nil
+}
+
+func parsePEMKey(path string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key file is not PEM encoded")
+	}
+	return parse(block.Bytes)
+}
+
+// lookupKey is the jwt.Keyfunc used when parsing tokens. The key is chosen by
+// the kid header and must match the algorithm the token claims to use.
+func lookupKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+// JWK is a public key in the JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKeys returns the asymmetric verification keys so other services can
+// check tokens without calling us. HS256 secrets are never published.
+func PublicKeys() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range keys {
+		if jwk, ok := toJWK(key.id, key.method.Alg(), key.verifyKey); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].Kid < set.Keys[j].Kid
+	})
+	return set
+}
+
+func toJWK(kid, alg string, key crypto.PublicKey) (JWK, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: alg,
+			Kid: kid,
+			N:   encode(key.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Use: "sig",
+			Alg: alg,
+			Kid: kid,
+			Crv: "Ed25519",
+			X:   encode(key),
+		}, true
+	}
+	return JWK{}, false
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+const principalKey = "principal"
+
+// Principal is the authenticated caller of a request. Handlers read it from
+// the context instead of parsing credentials themselves, so they don't
+// depend on where the credentials came from.
+type Principal struct {
+	Id     int
+	Login  string
+	Role   string
+	Scopes []string
+	// Claims is set when the caller authenticated with an access token.
+	Claims *JWTClaim
+	// APIKeyId is set when the caller authenticated with an API key.
+	APIKeyId int
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	return containsScope(p.Scopes, scope)
+}
+
+func SetPrincipal(c *gin.Context, principal *Principal) {
+	c.Set(principalKey, principal)
+}
+
+// GetPrincipal returns the caller stored by middleware.Auth. It panics when
+// called from a route that isn't behind the middleware.
+func GetPrincipal(c *gin.Context) *Principal {
+	return c.MustGet(principalKey).(*Principal)
+}
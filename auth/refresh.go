@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"social-media/database"
+	"social-media/hash"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// refreshTokenTTL is how long a refresh token stays usable; every
+	// rotation starts a new period, which makes the session sliding.
+	refreshTokenTTL = 14 * 24 * time.Hour
+	// refreshFamilyTTL caps the lifetime of a chain of rotated tokens, after
+	// which the user has to log in again.
+	refreshFamilyTTL = 90 * 24 * time.Hour
+	// refreshReuseGrace is how long after a rotation the old refresh token
+	// is still exchanged instead of being treated as stolen, so that
+	// parallel requests sharing one cookie don't log the user out.
+	refreshReuseGrace = 30 * time.Second
+)
+
+// Outcomes of presenting a refresh token, decided by checkRefresh.
+const (
+	refreshRotate = iota
+	refreshInvalid
+	refreshReused
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// TokenPair is handed to the client after login and on every refresh.
+type TokenPair struct {
+	AccessToken      string    `json:"token"`
+	RefreshToken     string    `json:"refreshToken"`
+	RefreshExpiresAt time.Time `json:"refreshExpiresAt"`
+}
+
+// NewSession issues an access token together with a refresh token that
+// starts a new token family.
+func NewSession(id int, login string) (TokenPair, error) {
+	var pair TokenPair
+	family, err := hash.RandomToken(16)
+	if err != nil {
+		return pair, err
+	}
+	now := time.Now()
+	refreshToken, expiresAt, err := insertRefreshToken(context.Background(), database.PostgreConn, id, family, now.Add(refreshFamilyTTL))
+	if err != nil {
+		return pair, err
+	}
+	grants, err := LoadGrants(id)
+	if err != nil {
+		return pair, err
+	}
+	accessToken, err := GenerateJWT(id, login, family, grants)
+	if err != nil {
+		return pair, err
+	}
+	return TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: expiresAt,
+	}, nil
+}
+
+// checkRefresh decides what to do with a refresh token given its state. A
+// token used less than refreshReuseGrace ago is rotated again; used earlier,
+// only a stolen copy can be replayed and the family has to be revoked.
+func checkRefresh(now, expiresAt time.Time, usedAt, revokedAt *time.Time) int {
+	switch {
+	case revokedAt != nil:
+		return refreshInvalid
+	case usedAt != nil && now.Sub(*usedAt) > refreshReuseGrace:
+		return refreshReused
+	case now.After(expiresAt):
+		return refreshInvalid
+	}
+	return refreshRotate
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. The old
+// refresh token is marked as used; presenting it again after
+// refreshReuseGrace revokes every token of its family. Within the grace
+// window it gets a new child of its own, the earlier one staying valid.
+func RefreshSession(refreshToken string) (TokenPair, error) {
+	var pair TokenPair
+	ctx := context.Background()
+	tx, err := database.PostgreConn.Begin(ctx)
+	if err != nil {
+		return pair, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		tokenId         int
+		userId          int
+		login           string
+		family          string
+		expiresAt       time.Time
+		familyExpiresAt time.Time
+		usedAt          *time.Time
+		revokedAt       *time.Time
+	)
+	err = tx.QueryRow(ctx, `select t.id, t.user_id, u.login, t.family_id, t.expires_at, t.family_expires_at, t.used_at, t.revoked_at
+		from refresh_tokens t join users u on u.id = t.user_id
+		where t.token_hash=$1 for update of t`, hash.HashToken(refreshToken)).
+		Scan(&tokenId, &userId, &login, &family, &expiresAt, &familyExpiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pair, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return pair, err
+	}
+
+	switch checkRefresh(time.Now(), expiresAt, usedAt, revokedAt) {
+	case refreshInvalid:
+		return pair, ErrInvalidRefreshToken
+	case refreshReused:
+		if _, err := tx.Exec(ctx, "update refresh_tokens set revoked_at=now() where family_id=$1 and revoked_at is null", family); err != nil {
+			return pair, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return pair, err
+		}
+		return pair, ErrRefreshTokenReused
+	}
+
+	if usedAt == nil {
+		if _, err := tx.Exec(ctx, "update refresh_tokens set used_at=now() where id=$1", tokenId); err != nil {
+			return pair, err
+		}
+	}
+	newToken, newExpiresAt, err := insertRefreshToken(ctx, tx, userId, family, familyExpiresAt)
+	if err != nil {
+		return pair, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return pair, err
+	}
+
+	grants, err := LoadGrants(userId)
+	if err != nil {
+		return pair, err
+	}
+	accessToken, err := GenerateJWT(userId, login, family, grants)
+	if err != nil {
+		return pair, err
+	}
+	return TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     newToken,
+		RefreshExpiresAt: newExpiresAt,
+	}, nil
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func insertRefreshToken(ctx context.Context, conn execer, userId int, family string, familyExpiresAt time.Time) (string, time.Time, error) {
+	token, err := hash.RandomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(refreshTokenTTL)
+	if expiresAt.After(familyExpiresAt) {
+		expiresAt = familyExpiresAt
+	}
+	_, err = conn.Exec(ctx, "insert into refresh_tokens (user_id, family_id, token_hash, expires_at, family_expires_at) values ($1, $2, $3, $4, $5)",
+		userId, family, hash.HashToken(token), expiresAt, familyExpiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// RevokeFamily revokes every refresh token issued for one device.
+func RevokeFamily(family string) error {
+	_, err := database.PostgreConn.Exec(context.Background(), "update refresh_tokens set revoked_at=now() where family_id=$1 and revoked_at is null", family)
+	return err
+}
+
+// RevokeUserRefreshTokens revokes the refresh tokens of all devices of a user.
+func RevokeUserRefreshTokens(userId int) error {
+	_, err := database.PostgreConn.Exec(context.Background(), "update refresh_tokens set revoked_at=now() where user_id=$1 and revoked_at is null", userId)
+	return err
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckRefresh(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		usedAt    *time.Time
+		revokedAt *time.Time
+		want      int
+	}{
+		{name: "unused", expiresAt: now.Add(time.Hour), want: refreshRotate},
+		{name: "expired", expiresAt: now.Add(-time.Second), want: refreshInvalid},
+		{name: "revoked", expiresAt: now.Add(time.Hour), revokedAt: at(-time.Minute), want: refreshInvalid},
+		{name: "used within grace", expiresAt: now.Add(time.Hour), usedAt: at(-refreshReuseGrace / 2), want: refreshRotate},
+		{name: "used at grace end", expiresAt: now.Add(time.Hour), usedAt: at(-refreshReuseGrace), want: refreshRotate},
+		{name: "used after grace", expiresAt: now.Add(time.Hour), usedAt: at(-refreshReuseGrace - time.Second), want: refreshReused},
+		{name: "used and expired", expiresAt: now.Add(-time.Second), usedAt: at(-time.Second), want: refreshInvalid},
+		{name: "replayed after expiry", expiresAt: now.Add(-time.Hour), usedAt: at(-2 * time.Hour), want: refreshReused},
+		{name: "used and revoked", expiresAt: now.Add(time.Hour), usedAt: at(-time.Hour), revokedAt: at(-time.Minute), want: refreshInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkRefresh(now, tt.expiresAt, tt.usedAt, tt.revokedAt); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
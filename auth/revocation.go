@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"social-media/database"
+	"sync"
+	"time"
+)
+
+// revoked caches the denylist so ValidateToken doesn't query Postgres on
+// every request. It is reloaded periodically to pick up revocations made by
+// other instances.
+var revoked = revocationList{
+	tokens:   make(map[string]time.Time),
+	sessions: make(map[string]time.Time),
+	users:    make(map[int]time.Time),
+}
+
+type revocationList struct {
+	mux sync.RWMutex
+	// tokens maps a jti to the moment the token expires anyway.
+	tokens map[string]time.Time
+	// sessions maps a refresh token family to the moment the last access
+	// token issued for it expires.
+	sessions map[string]time.Time
+	// users maps a user id to the moment up to which all of their access
+	// tokens are revoked.
+	users map[int]time.Time
+}
+
+// Revoked reports whether a token was revoked individually, with the device
+// it was issued to or by a "log out everywhere" of its owner.
+func Revoked(claims *JWTClaim) bool {
+	revoked.mux.RLock()
+	defer revoked.mux.RUnlock()
+	if _, ok := revoked.tokens[claims.Id]; ok {
+		return true
+	}
+	if _, ok := revoked.sessions[claims.Session]; ok && claims.Session != "" {
+		return true
+	}
+	if before, ok := revoked.users[claims.ID]; ok && !claims.issuedAt().After(before) {
+		return true
+	}
+	return false
+}
+
+// RevokeToken puts a single access token on the denylist until it expires.
+func RevokeToken(claims *JWTClaim) error {
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	_, err := database.PostgreConn.Exec(context.Background(), "insert into revoked_tokens (jti, user_id, expires_at) values ($1, $2, $3) on conflict (jti) do nothing", claims.Id, claims.ID, expiresAt)
+	if err != nil {
+		return err
+	}
+	revoked.mux.Lock()
+	revoked.tokens[claims.Id] = expiresAt
+	revoked.mux.Unlock()
+	return nil
+}
+
+// RevokeSession revokes every access token issued for a refresh token
+// family, which is what logging out a single device needs: the device may
+// hold tokens from earlier refreshes besides the one it logged out with.
+func RevokeSession(session string) error {
+	expiresAt := time.Now().Add(accessTokenTTL)
+	_, err := database.PostgreConn.Exec(context.Background(), `insert into revoked_sessions (session, expires_at) values ($1, $2)
+		on conflict (session) do update set expires_at=excluded.expires_at`, session, expiresAt)
+	if err != nil {
+		return err
+	}
+	revoked.mux.Lock()
+	revoked.sessions[session] = expiresAt
+	revoked.mux.Unlock()
+	return nil
+}
+
+// RevokeUser revokes every access token issued to a user so far.
+func RevokeUser(userId int) error {
+	now := time.Now()
+	_, err := database.PostgreConn.Exec(context.Background(), `insert into revoked_users (user_id, revoked_before, expires_at) values ($1, $2, $3)
+		on conflict (user_id) do update set revoked_before=excluded.revoked_before, expires_at=excluded.expires_at`, userId, now, now.Add(accessTokenTTL))
+	if err != nil {
+		return err
+	}
+	revoked.mux.Lock()
+	revoked.users[userId] = now
+	revoked.mux.Unlock()
+	return nil
+}
+
+// StartRevocationSync loads the denylist and keeps it in sync, deleting
+// entries whose tokens have expired in the meantime.
+func StartRevocationSync(interval time.Duration) {
+	if err := syncRevocations(); err != nil {
+		log.Println(err)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := syncRevocations(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+func syncRevocations() error {
+	ctx := context.Background()
+	conn := database.PostgreConn
+	if _, err := conn.Exec(ctx, "delete from revoked_tokens where expires_at < now()"); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "delete from revoked_sessions where expires_at < now()"); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "delete from revoked_users where expires_at < now()"); err != nil {
+		return err
+	}
+
+	tokens := make(map[string]time.Time)
+	rows, err := conn.Query(ctx, "select jti, expires_at from revoked_tokens")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[jti] = expiresAt
+	}
+	rows.Close()
+
+	sessions := make(map[string]time.Time)
+	rows, err = conn.Query(ctx, "select session, expires_at from revoked_sessions")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var session string
+		var expiresAt time.Time
+		if err := rows.Scan(&session, &expiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		sessions[session] = expiresAt
+	}
+	rows.Close()
+
+	users := make(map[int]time.Time)
+	rows, err = conn.Query(ctx, "select user_id, revoked_before from revoked_users")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var userId int
+		var before time.Time
+		if err := rows.Scan(&userId, &before); err != nil {
+			rows.Close()
+			return err
+		}
+		users[userId] = before
+	}
+	rows.Close()
+
+	// Entries revoked locally while the tables were being read are kept
+	// until they expire so they can't slip through until the next sync.
+	now := time.Now()
+	revoked.mux.Lock()
+	for jti, expiresAt := range revoked.tokens {
+		if _, ok := tokens[jti]; !ok && expiresAt.After(now) {
+			tokens[jti] = expiresAt
+		}
+	}
+	for session, expiresAt := range revoked.sessions {
+		if expiresAt.After(sessions[session]) && expiresAt.After(now) {
+			sessions[session] = expiresAt
+		}
+	}
+	for userId, before := range revoked.users {
+		if before.After(users[userId]) && before.Add(accessTokenTTL).After(now) {
+			users[userId] = before
+		}
+	}
+	revoked.tokens = tokens
+	revoked.sessions = sessions
+	revoked.users = users
+	revoked.mux.Unlock()
+	return nil
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRevokedUser(t *testing.T) {
+	before := time.Date(2023, 5, 1, 12, 0, 0, 500000000, time.UTC)
+	revoked.mux.Lock()
+	revoked.users = map[int]time.Time{1: before}
+	revoked.mux.Unlock()
+	defer func() {
+		revoked.mux.Lock()
+		revoked.users = make(map[int]time.Time)
+		revoked.mux.Unlock()
+	}()
+
+	claims := func(userId int, issued time.Time, micro bool) *JWTClaim {
+		c := &JWTClaim{ID: userId, StandardClaims: jwt.StandardClaims{IssuedAt: issued.Unix()}}
+		if micro {
+			c.IssuedAtMicro = issued.UnixMicro()
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		claims *JWTClaim
+		want   bool
+	}{
+		{name: "issued before", claims: claims(1, before.Add(-time.Minute), true), want: true},
+		{name: "issued earlier in the same second", claims: claims(1, before.Add(-time.Millisecond), true), want: true},
+		{name: "issued later in the same second", claims: claims(1, before.Add(time.Millisecond), true), want: false},
+		{name: "issued after", claims: claims(1, before.Add(time.Minute), true), want: false},
+		{name: "seconds only, same second", claims: claims(1, before.Add(time.Millisecond), false), want: true},
+		{name: "other user", claims: claims(2, before.Add(-time.Minute), true), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Revoked(tt.claims); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
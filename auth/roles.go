@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"social-media/database"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	// ScopeModeratePosts allows removing posts of other users; only authors
+	// may edit them.
+	ScopeModeratePosts = "posts:moderate"
+	// ScopeModerateComments allows removing comments of other users.
+	ScopeModerateComments = "comments:moderate"
+	// ScopeManageUsers allows changing roles and scopes of other users.
+	ScopeManageUsers = "users:manage"
+)
+
+// Scopes lists every scope known to the server.
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeModeratePosts, ScopeModerateComments, ScopeManageUsers}
+
+// roleScopes are the scopes each role grants by default. Extra scopes can be
+// granted to single users through the user_scopes table.
+var roleScopes = map[string][]string{
+	RoleUser:      {ScopeRead, ScopeWrite},
+	RoleModerator: {ScopeRead, ScopeWrite, ScopeModeratePosts, ScopeModerateComments},
+	RoleAdmin:     {ScopeRead, ScopeWrite, ScopeModeratePosts, ScopeModerateComments, ScopeManageUsers},
+}
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// Grants are the role and scopes encoded into access tokens.
+type Grants struct {
+	Role   string
+	Scopes []string
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+func ValidScope(scope string) bool {
+	return containsScope(Scopes, scope)
+}
+
+// LoadGrants reads the role of a user and combines its default scopes with
+// the ones granted to the user directly.
+func LoadGrants(userId int) (Grants, error) {
+	var grants Grants
+	var extra []string
+	err := database.PostgreConn.QueryRow(context.Background(), "select role, coalesce((select array_agg(scope) from user_scopes where user_id=users.id), '{}') from users where id=$1", userId).
+		Scan(&grants.Role, &extra)
+	if err != nil {
+		return grants, err
+	}
+	grants.Scopes = append([]string{}, roleScopes[grants.Role]...)
+	for _, scope := range extra {
+		if !containsScope(grants.Scopes, scope) {
+			grants.Scopes = append(grants.Scopes, scope)
+		}
+	}
+	return grants, nil
+}
+
+func SetRole(userId int, role string) error {
+	if !ValidRole(role) {
+		return ErrUnknownRole
+	}
+	_, err := database.PostgreConn.Exec(context.Background(), "update users set role=$1 where id=$2", role, userId)
+	return err
+}
+
+// GrantScope gives a user a scope on top of the ones of its role.
+func GrantScope(userId int, scope string) error {
+	_, err := database.PostgreConn.Exec(context.Background(), "insert into user_scopes (user_id, scope) values ($1, $2) on conflict do nothing", userId, scope)
+	return err
+}
+
+func RevokeScope(userId int, scope string) error {
+	_, err := database.PostgreConn.Exec(context.Background(), "delete from user_scopes where user_id=$1 and scope=$2", userId, scope)
+	return err
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package auth
+
+import "testing"
+
+func TestRoleScopes(t *testing.T) {
+	tests := []struct {
+		role   string
+		scope  string
+		grants bool
+	}{
+		{RoleUser, ScopeRead, true},
+		{RoleUser, ScopeWrite, true},
+		{RoleUser, ScopeModeratePosts, false},
+		{RoleUser, ScopeModerateComments, false},
+		{RoleUser, ScopeManageUsers, false},
+		{RoleModerator, ScopeWrite, true},
+		{RoleModerator, ScopeModeratePosts, true},
+		{RoleModerator, ScopeModerateComments, true},
+		{RoleModerator, ScopeManageUsers, false},
+		{RoleAdmin, ScopeModerateComments, true},
+		{RoleAdmin, ScopeManageUsers, true},
+	}
+	for _, tt := range tests {
+		if got := containsScope(roleScopes[tt.role], tt.scope); got != tt.grants {
+			t.Errorf("%s grants %s: got %v, want %v", tt.role, tt.scope, got, tt.grants)
+		}
+	}
+}
+
+func TestRoleScopesAreKnown(t *testing.T) {
+	for role, scopes := range roleScopes {
+		if !ValidRole(role) {
+			t.Errorf("role %q isn't valid", role)
+		}
+		for _, scope := range scopes {
+			if !ValidScope(scope) {
+				t.Errorf("role %q grants unknown scope %q", role, scope)
+			}
+		}
+	}
+}
+
+func TestValidRole(t *testing.T) {
+	tests := []struct {
+		role  string
+		valid bool
+	}{
+		{RoleUser, true},
+		{RoleModerator, true},
+		{RoleAdmin, true},
+		{"", false},
+		{"owner", false},
+		{"Admin", false},
+	}
+	for _, tt := range tests {
+		if got := ValidRole(tt.role); got != tt.valid {
+			t.Errorf("ValidRole(%q) = %v, want %v", tt.role, got, tt.valid)
+		}
+	}
+}
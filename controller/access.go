@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"social-media/database"
+	"social-media/models"
+	"social-media/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Room actions checked by checkMember and written to the audit log.
+const (
+	roomActionRead   = "room.read"
+	roomActionPost   = "room.post"
+	roomActionWatch  = "room.watch"
+	roomActionManage = "room.manage"
+)
+
+// roomAccessError is returned when a user acts on a room it isn't a member
+// of. It matches errNotMember.
+type roomAccessError struct {
+	RoomId int
+	UserId int
+	Action string
+}
+
+func (e *roomAccessError) Error() string {
+	return fmt.Sprintf("user %d is not a member of room %d (%s)", e.UserId, e.RoomId, e.Action)
+}
+
+func (e *roomAccessError) Is(target error) bool {
+	return target == errNotMember
+}
+
+// checkMember returns the role of the user in the room and whether the room
+// is read-only. The cached room is used when there is one, Postgres
+// otherwise. A non-member gets a *roomAccessError and the attempt is audited.
+func checkMember(roomId, userId int, action string) (string, bool, error) {
+	role, readOnly, cached := models.ActiveRoom.Member(roomId, userId)
+	if !cached {
+		room, err := loadRoom(roomId)
+		if err != nil {
+			return "", false, err
+		}
+		role, readOnly = room.Roles[userId], room.ReadOnly
+	}
+	if role == "" {
+		return "", false, denyRoom(roomId, userId, action)
+	}
+	return role, readOnly, nil
+}
+
+// denyRoom audits an attempt by a non-member to act on a room and returns the
+// error to answer it with.
+func denyRoom(roomId, userId int, action string) error {
+	err := &roomAccessError{RoomId: roomId, UserId: userId, Action: action}
+	audit(userId, action, fmt.Sprintf("room:%d", roomId), err.Error())
+	return err
+}
+
+// abortRoomError answers a request that failed a room check.
+func abortRoomError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNoRoom):
+		c.String(404, "room not found")
+	case errors.Is(err, errNotMember):
+		c.String(403, "not a member of the room")
+	case errors.Is(err, errReadOnly):
+		c.String(403, "only admins can post in the room")
+	default:
+		log.Println(err)
+		c.String(500, "internal error")
+	}
+}
+
+// wsRoomError converts the error of a room check to a WebSocket error.
+func wsRoomError(err error) error {
+	switch {
+	case errors.Is(err, errNoRoom):
+		return ws.NewError(ws.ErrNotFound, "room not found")
+	case errors.Is(err, errNotMember):
+		return ws.NewError(ws.ErrForbidden, "not a member of the room")
+	case errors.Is(err, errReadOnly):
+		return ws.NewError(ws.ErrForbidden, "only admins can post in the room")
+	}
+	return err
+}
+
+// audit records a denied or sensitive action. Failures are only logged.
+func audit(userId int, action, target, detail string) {
+	log.Printf("audit: user %d %s %s: %s", userId, action, target, detail)
+	conn := database.PostgreConn
+	_, err := conn.Exec(context.Background(), "insert into audit_log (user_id, action, target, detail) values ($1, $2, $3, $4)", userId, action, target, detail)
+	if err != nil {
+		log.Println(err)
+	}
+}
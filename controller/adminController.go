@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"log"
+	"social-media/auth"
+	"social-media/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetUserGrants(c *gin.Context) {
+	id, err := getIdByLogin(c.Param("login"))
+	if err != nil {
+		log.Println(err)
+		c.String(404, "not found")
+		return
+	}
+
+	grants, err := auth.LoadGrants(id)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"role":   grants.Role,
+		"scopes": grants.Scopes,
+	})
+}
+
+func ChangeUserRole(c *gin.Context) {
+	id, err := getIdByLogin(c.Param("login"))
+	if err != nil {
+		log.Println(err)
+		c.String(404, "not found")
+		return
+	}
+	if id == auth.GetPrincipal(c).Id {
+		c.String(403, "can't change own role")
+		return
+	}
+	role := c.PostForm("role")
+	if !auth.ValidRole(role) {
+		c.String(400, "unknown role")
+		return
+	}
+
+	if err := auth.SetRole(id, role); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	revokeGrants(c, id)
+}
+
+func GrantUserScope(c *gin.Context) {
+	id, err := getIdByLogin(c.Param("login"))
+	if err != nil {
+		log.Println(err)
+		c.String(404, "not found")
+		return
+	}
+	scope := c.PostForm("scope")
+	if !auth.ValidScope(scope) {
+		c.String(400, "unknown scope")
+		return
+	}
+
+	if err := auth.GrantScope(id, scope); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	revokeGrants(c, id)
+}
+
+func RevokeUserScope(c *gin.Context) {
+	id, err := getIdByLogin(c.Param("login"))
+	if err != nil {
+		log.Println(err)
+		c.String(404, "not found")
+		return
+	}
+
+	if err := auth.RevokeScope(id, c.Param("scope")); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	revokeGrants(c, id)
+}
+
+// revokeGrants invalidates the access tokens and closes the WebSockets of a
+// user whose grants changed. Their refresh tokens stay valid, so the next
+// token they get carries the new role and scopes.
+func revokeGrants(c *gin.Context, id int) {
+	if err := auth.RevokeUser(id); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	ws.Hub.Disconnect(id, ws.CloseLoggedOut, "grants changed")
+	c.Status(204)
+}
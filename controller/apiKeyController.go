@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"log"
+	"social-media/auth"
+	"social-media/ws"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateAPIKey issues a key for scripts and server-to-server jobs. The plain
+// key is only returned here.
+func CreateAPIKey(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+	if principal.APIKeyId != 0 {
+		c.String(403, "api keys can't manage api keys")
+		return
+	}
+
+	name := c.PostForm("name")
+	if name == "" {
+		c.String(400, "no name")
+		return
+	}
+	scopes := strings.Split(c.DefaultPostForm("scopes", auth.ScopeRead), ",")
+	for i, scope := range scopes {
+		scopes[i] = strings.TrimSpace(scope)
+		if !auth.ValidScope(scopes[i]) {
+			c.String(400, "unknown scope "+scopes[i])
+			return
+		}
+		if !principal.HasScope(scopes[i]) {
+			c.String(403, "scope not granted "+scopes[i])
+			return
+		}
+	}
+	var expiresAt *time.Time
+	if raw := c.PostForm("expiresIn"); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days <= 0 {
+			c.String(400, "invalid param")
+			return
+		}
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+
+	plain, key, err := auth.CreateAPIKey(principal.Id, name, scopes, expiresAt)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"key":    plain,
+		"apiKey": key,
+	})
+}
+
+func GetAPIKeys(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+
+	keys, err := auth.ListAPIKeys(id)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, keys)
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+	if principal.APIKeyId != 0 {
+		c.String(403, "api keys can't manage api keys")
+		return
+	}
+	keyId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return
+	}
+
+	ok, err := auth.RevokeAPIKey(principal.Id, keyId)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if !ok {
+		c.String(404, "not found")
+		return
+	}
+	ws.Hub.DisconnectAPIKey(principal.Id, keyId, ws.CloseLoggedOut, "api key revoked")
+
+	c.Status(204)
+}
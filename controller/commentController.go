@@ -2,37 +2,63 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"log"
 	"social-media/auth"
 	"social-media/database"
+	"social-media/ws"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// maxCommentDepth is the deepest a reply can be nested, top-level comments
+// being at depth 0. Replies to a comment at that depth become its siblings.
+const maxCommentDepth = 5
+
+var (
+	errBadComment = errors.New("invalid comment id")
+	errNoComment  = errors.New("comment not found on post")
+)
+
+// Values of the view query param of GetComments.
+const (
+	commentsTree = "tree"
+	commentsFlat = "flat"
+)
+
+// PostComment comments a post, or replies to the comment given in the
+// parentId form field.
 func PostComment(c *gin.Context) {
-	token, err := c.Cookie("token")
+	principal := auth.GetPrincipal(c)
+	id, login := principal.Id, principal.Login
+	rawId := c.PostForm("postId")
+	postId, err := primitive.ObjectIDFromHex(rawId)
 	if err != nil {
 		log.Println(err)
-		c.String(400, "no token")
+		c.String(500, "internal error")
 		return
 	}
-	id, login, err := auth.TokenCredentials(token)
-	if err != nil {
-		log.Println(err)
-		c.String(400, "invalid credentials")
+	text := c.PostForm("text")
+
+	parent, err := commentParent(rawId, c.PostForm("parentId"))
+	if errors.Is(err, errBadComment) {
+		c.String(400, "invalid form field")
+		return
+	}
+	if errors.Is(err, errNoComment) {
+		c.String(404, "parent comment not found")
 		return
 	}
-	rawId := c.PostForm("postId")
-	postId, err := primitive.ObjectIDFromHex(rawId)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
-	text := c.PostForm("text")
+
 	form, err := c.MultipartForm()
 	if err != nil {
 		log.Println(err)
@@ -53,66 +79,269 @@ func PostComment(c *gin.Context) {
 	}
 
 	req := generateCommentRequest(rawId, text, id, imgPath, filesPath)
+	if parent != nil {
+		setCommentParent(req, parent)
+	}
 
 	commentColl := database.MI.DB.Collection("comments")
 	res, err := commentColl.InsertOne(context.Background(), req)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
+		return
 	}
 	insertedId := idToHex(res.InsertedID)
-	if insertedId == "" {
-		log.Println(err)
-		c.String(500, "internal error")
-	}
+	req["_id"] = insertedId
 	req["login"] = login
 
 	postsColl := database.MI.DB.Collection("posts")
-	_, err = postsColl.UpdateByID(context.Background(), postId, bson.D{{"$push", bson.D{{"comments", insertedId}}}}, options.Update())
+	_, err = postsColl.UpdateByID(context.Background(), postId, bson.D{{Key: "$push", Value: bson.D{{Key: "comments", Value: insertedId}}}}, options.Update())
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
+		return
+	}
+
+	if parent != nil {
+		notifyCommentReply(parent, req)
 	}
 
 	c.JSON(200, req)
 }
 
+// GetComments returns a page of the top-level comments of a post with all
+// their replies. With ?view=tree, the default, replies are nested in the
+// replies field of their parent; with ?view=flat they follow their parent in
+// the items, each with its depth.
 func GetComments(c *gin.Context) {
 	postId := c.Param("postId")
+	view := c.DefaultQuery("view", commentsTree)
+	if view != commentsTree && view != commentsFlat {
+		c.String(400, "invalid param")
+		return
+	}
+	q, err := parsePageQuery(c, directionAsc)
+	if err != nil {
+		c.String(400, "invalid param")
+		return
+	}
+
+	res, err := findPage("comments", bson.M{"postId": postId, "parentId": bson.M{"$exists": false}}, q)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	replies, err := getReplies(res.Items)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if err := setAuthors(append(replies, res.Items...), "id"); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	if view == commentsTree {
+		nestReplies(res.Items, replies)
+	} else {
+		res.Items = flattenReplies(res.Items, replies)
+	}
+
+	c.JSON(200, res)
+}
+
+// DeleteComment removes the comment :id. Authors can delete their comments
+// and moderators any comment. The comment stays in place without its
+// content, so its replies keep their parent.
+func DeleteComment(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.String(400, "invalid param")
+		return
+	}
 
 	coll := database.MI.DB.Collection("comments")
-	var res []bson.M
-	cursor, err := coll.Find(context.Background(), bson.D{{"postId", postId}})
+	var comment bson.M
+	err = coll.FindOne(context.Background(), bson.M{"_id": id}).Decode(&comment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "not found")
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
+	if intValue(comment["id"]) != principal.Id && !principal.HasScope(auth.ScopeModerateComments) {
+		c.String(403, "forbidden")
+		return
+	}
+	if deleted, _ := comment["deleted"].(bool); deleted {
+		c.Status(204)
+		return
+	}
 
-	conn := database.PostgreConn
-	for cursor.Next(context.Background()) {
-		var post bson.M
-		err := cursor.Decode(&post)
-		if err != nil {
-			log.Println(err)
+	update := bson.M{
+		"$set":   bson.M{"deleted": true, "deletedBy": principal.Id, "updatedAt": timestamp()},
+		"$unset": bson.M{"text": "", "images": "", "files": ""},
+	}
+	if _, err := coll.UpdateOne(context.Background(), bson.M{"_id": id}, update); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	removeUploads(attachmentPaths(comment))
+
+	c.Status(204)
+}
+
+// commentParent loads the comment a reply answers, given its hex id. There is
+// no parent when the id is empty.
+func commentParent(postId, rawId string) (bson.M, error) {
+	if rawId == "" {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		return nil, errBadComment
+	}
+	var parent bson.M
+	coll := database.MI.DB.Collection("comments")
+	err = coll.FindOne(context.Background(), bson.M{"_id": id, "postId": postId}).Decode(&parent)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errNoComment
+	}
+	return parent, err
+}
+
+// setCommentParent places a reply under its parent. rootId is the top-level
+// comment of the thread, used to load whole threads at once. A reply past
+// maxCommentDepth is attached to the parent's parent instead.
+func setCommentParent(req, parent bson.M) {
+	depth := intValue(parent["depth"]) + 1
+	parentId := idToHex(parent["_id"])
+	if depth > maxCommentDepth {
+		depth = maxCommentDepth
+		parentId, _ = parent["parentId"].(string)
+	}
+	rootId, ok := parent["rootId"].(string)
+	if !ok {
+		rootId = idToHex(parent["_id"])
+	}
+
+	req["parentId"] = parentId
+	req["rootId"] = rootId
+	req["depth"] = depth
+}
+
+// notifyCommentReply tells the author of a comment about a reply to it. The
+// reply carries the parent it was stored under, which is an ancestor of the
+// comment when the comment is at maxCommentDepth.
+func notifyCommentReply(parent, reply bson.M) {
+	authorId := intValue(parent["id"])
+	if authorId == intValue(reply["id"]) {
+		return
+	}
+	ws.Hub.SendToUser(authorId, ws.Event{
+		Type: "comment.reply",
+		Payload: map[string]interface{}{
+			"type":      "comment.reply",
+			"postId":    reply["postId"],
+			"parentId":  reply["parentId"],
+			"commentId": reply["_id"],
+			"login":     reply["login"],
+			"text":      reply["text"],
+		},
+	})
+}
+
+// getReplies loads the replies of the threads started by the given top-level
+// comments, oldest first.
+func getReplies(comments []bson.M) ([]bson.M, error) {
+	replies := []bson.M{}
+	var rootIds bson.A
+	for _, comment := range comments {
+		rootIds = append(rootIds, idToHex(comment["_id"]))
+	}
+	if len(rootIds) == 0 {
+		return replies, nil
+	}
+
+	coll := database.MI.DB.Collection("comments")
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := coll.Find(context.Background(), bson.M{"rootId": bson.M{"$in": rootIds}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(context.Background(), &replies); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// childrenOf groups replies by the hex id of their parent, keeping their
+// order.
+func childrenOf(replies []bson.M) map[string][]bson.M {
+	children := make(map[string][]bson.M)
+	for _, reply := range replies {
+		parentId, _ := reply["parentId"].(string)
+		children[parentId] = append(children[parentId], reply)
+	}
+	return children
+}
+
+// nestReplies sets the replies field of each comment to its direct replies,
+// recursively.
+func nestReplies(comments, replies []bson.M) {
+	children := childrenOf(replies)
+	var nest func(comment bson.M)
+	nest = func(comment bson.M) {
+		list := children[idToHex(comment["_id"])]
+		for _, reply := range list {
+			nest(reply)
 		}
-		var login string
-		err = conn.QueryRow(context.Background(), "select login from users where id=$1", post["id"]).Scan(&login)
-		if err != nil {
-			continue
+		if list == nil {
+			list = []bson.M{}
 		}
-		post["login"] = login
-		res = append(res, post)
+		comment["replies"] = list
 	}
+	for _, comment := range comments {
+		nest(comment)
+	}
+}
 
-	c.JSON(200, res)
+// flattenReplies lists each comment followed by its replies, depth first, and
+// sets the depth of every item.
+func flattenReplies(comments, replies []bson.M) []bson.M {
+	children := childrenOf(replies)
+	items := []bson.M{}
+	var walk func(comment bson.M, depth int)
+	walk = func(comment bson.M, depth int) {
+		comment["depth"] = depth
+		items = append(items, comment)
+		for _, reply := range children[idToHex(comment["_id"])] {
+			walk(reply, depth+1)
+		}
+	}
+	for _, comment := range comments {
+		walk(comment, 0)
+	}
+	return items
 }
 
 func generateCommentRequest(postId, text string, id int, images, files []string) bson.M {
+	now := timestamp()
 	req := bson.M{
-		"text":   text,
-		"id":     id,
-		"postId": postId,
+		"text":      text,
+		"id":        id,
+		"postId":    postId,
+		"createdAt": now,
+		"updatedAt": now,
 	}
 
 	if len(images) != 0 {
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSetCommentParent(t *testing.T) {
+	id := primitive.NewObjectID()
+	root, grandparent := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name   string
+		parent bson.M
+		want   bson.M
+	}{
+		{
+			name:   "reply to top-level comment",
+			parent: bson.M{"_id": id},
+			want:   bson.M{"parentId": id.Hex(), "rootId": id.Hex(), "depth": 1},
+		},
+		{
+			name:   "nested reply",
+			parent: bson.M{"_id": id, "parentId": grandparent, "rootId": root, "depth": int32(2)},
+			want:   bson.M{"parentId": id.Hex(), "rootId": root, "depth": 3},
+		},
+		{
+			name:   "reply at the deepest level",
+			parent: bson.M{"_id": id, "parentId": grandparent, "rootId": root, "depth": int32(maxCommentDepth - 1)},
+			want:   bson.M{"parentId": id.Hex(), "rootId": root, "depth": maxCommentDepth},
+		},
+		{
+			name:   "reply past the deepest level",
+			parent: bson.M{"_id": id, "parentId": grandparent, "rootId": root, "depth": int32(maxCommentDepth)},
+			want:   bson.M{"parentId": grandparent, "rootId": root, "depth": maxCommentDepth},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := bson.M{}
+			setCommentParent(req, tt.parent)
+			if !reflect.DeepEqual(req, tt.want) {
+				t.Errorf("got %v, want %v", req, tt.want)
+			}
+		})
+	}
+}
+
+// commentTree returns two top-level comments, the first one with a reply
+// that has a reply of its own, and the replies in creation order.
+func commentTree() (comments, replies []bson.M) {
+	a, b, a1, a11 := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	comments = []bson.M{{"_id": a}, {"_id": b}}
+	replies = []bson.M{
+		{"_id": a1, "parentId": a.Hex()},
+		{"_id": a11, "parentId": a1.Hex()},
+	}
+	return comments, replies
+}
+
+func TestNestReplies(t *testing.T) {
+	comments, replies := commentTree()
+	nestReplies(comments, replies)
+
+	want := []bson.M{
+		{"_id": comments[0]["_id"], "replies": []bson.M{
+			{"_id": replies[0]["_id"], "parentId": replies[0]["parentId"], "replies": []bson.M{
+				{"_id": replies[1]["_id"], "parentId": replies[1]["parentId"], "replies": []bson.M{}},
+			}},
+		}},
+		{"_id": comments[1]["_id"], "replies": []bson.M{}},
+	}
+	if !reflect.DeepEqual(comments, want) {
+		t.Errorf("got %v, want %v", comments, want)
+	}
+}
+
+func TestFlattenReplies(t *testing.T) {
+	comments, replies := commentTree()
+	items := flattenReplies(comments, replies)
+
+	tests := []struct {
+		id    interface{}
+		depth int
+	}{
+		{comments[0]["_id"], 0},
+		{replies[0]["_id"], 1},
+		{replies[1]["_id"], 2},
+		{comments[1]["_id"], 0},
+	}
+	if len(items) != len(tests) {
+		t.Fatalf("got %d items, want %d", len(items), len(tests))
+	}
+	for i, tt := range tests {
+		if items[i]["_id"] != tt.id || items[i]["depth"] != tt.depth {
+			t.Errorf("item %d: got %v at depth %v, want %v at depth %d", i, items[i]["_id"], items[i]["depth"], tt.id, tt.depth)
+		}
+	}
+}
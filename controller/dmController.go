@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"social-media/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Kinds of rooms.
+const (
+	roomGroup  = "group"
+	roomDirect = "direct"
+)
+
+// GetDirectRoom returns the direct room of the user with :login, creating it
+// on first use.
+func GetDirectRoom(c *gin.Context) {
+	openDirectRoom(c, c.Param("login"))
+}
+
+// NewDirectRoom is GetDirectRoom for the login form field.
+func NewDirectRoom(c *gin.Context) {
+	openDirectRoom(c, c.PostForm("login"))
+}
+
+func openDirectRoom(c *gin.Context, login string) {
+	principal := auth.GetPrincipal(c)
+
+	otherId, err := getIdByLogin(login)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.String(404, "user not found")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if otherId == principal.Id {
+		c.String(400, "can't message yourself")
+		return
+	}
+
+	roomId, created, err := findOrCreateDirectRoom(principal.Id, otherId)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	room, err := loadRoom(roomId)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	authors, err := getAuthors([]int{otherId})
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	if created {
+		syncRoom(room)
+		notifyRoom(room.Users, principal.Id, "created", room, nil)
+	}
+
+	view := roomView{Room: room}
+	if a, ok := authors[otherId]; ok {
+		view.Name = a.Login
+		view.Counterpart = &a
+	}
+	c.JSON(200, view)
+}
+
+// findOrCreateDirectRoom returns the direct room of two users. Rooms are keyed
+// by the ordered pair of ids so that concurrent calls agree on one room.
+func findOrCreateDirectRoom(userId, otherId int) (int, bool, error) {
+	if otherId < userId {
+		userId, otherId = otherId, userId
+	}
+	key := fmt.Sprintf("%d:%d", userId, otherId)
+
+	var roomId int
+	created := false
+	_, err := withTx(func(tx pgx.Tx) ([]int, error) {
+		err := tx.QueryRow(context.Background(), `insert into rooms (name, kind, dm_key) values ('', $1, $2)
+			on conflict (dm_key) do nothing returning id`, roomDirect, key).Scan(&roomId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, tx.QueryRow(context.Background(), "select id from rooms where dm_key=$1", key).Scan(&roomId)
+		}
+		if err != nil {
+			return nil, err
+		}
+		created = true
+		return addMembers(tx, roomId, []int{userId, otherId})
+	})
+	return roomId, created, err
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"log"
+	"social-media/auth"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// GetFeed returns the posts of every account the caller follows, newest
+// first, paginated like the other post lists.
+func GetFeed(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+
+	q, err := parsePageQuery(c, directionDesc)
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return
+	}
+
+	followees, err := followeesOf(id)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if len(followees) == 0 {
+		c.JSON(200, page{Items: []bson.M{}})
+		return
+	}
+
+	res, err := findPage("posts", bson.M{"userId": bson.M{"$in": followees}}, q)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	if err := setAuthors(res.Items, "userId"); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, res)
+}
@@ -2,35 +2,45 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"log"
 	"social-media/auth"
 	"social-media/database"
 	"social-media/models"
+	"social-media/ws"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func ReceiveMessage(c *gin.Context) {
-	token, err := c.Cookie("token")
+	principal := auth.GetPrincipal(c)
+	id, login := principal.Id, principal.Login
+	text := c.PostForm("text")
+	roomId, err := strconv.Atoi(c.PostForm("roomId"))
 	if err != nil {
-		log.Println(err)
-		c.String(400, "no token")
+		c.String(400, "invalid form field")
 		return
 	}
-	id, login, err := auth.TokenCredentials(token)
-	if err != nil {
-		log.Println(err)
-		c.String(400, "invalid credentials")
+	if err := checkPost(roomId, id); err != nil {
+		abortRoomError(c, err)
 		return
 	}
-	text := c.PostForm("text")
-	roomId, err := strconv.Atoi(c.PostForm("roomId"))
-	if err != nil {
+	parent, err := replyParent(roomId, c.PostForm("replyTo"))
+	if errors.Is(err, errNoMessage) {
 		c.String(400, "invalid form field")
 		return
 	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
 	form, err := c.MultipartForm()
 	if err != nil {
 		log.Println(err)
@@ -51,32 +61,195 @@ func ReceiveMessage(c *gin.Context) {
 		return
 	}
 
-	req := generateMsgRequest(text, id, roomId, imgPath, filesPath)
+	req, err := saveMessage(id, login, roomId, text, imgPath, filesPath, parent)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, req)
+}
+
+// saveMessage stores a chat message and pushes it to the other members of
+// the room. It is shared by the HTTP and the WebSocket way of sending. A
+// reply carries its parent and the root of its thread and quotes the parent.
+func saveMessage(id int, login string, roomId int, text string, images, files []string, parent bson.M) (bson.M, error) {
+	req := generateMsgRequest(text, id, roomId, images, files)
+	if parent != nil {
+		req["replyTo"] = parent["_id"]
+		req["threadId"] = threadRoot(parent)
+	}
 
 	coll := database.MI.DB.Collection("messages")
-	_, err = coll.InsertOne(context.Background(), req)
+	result, err := coll.InsertOne(context.Background(), req)
 	if err != nil {
-		c.String(500, "internal error")
+		return nil, err
 	}
+	req["_id"] = idToHex(result.InsertedID)
 
 	following, err := getRoomUsers(roomId)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	req["login"] = login
 	req["type"] = "msg"
-
-	for _, user := range following {
-		if user == id {
-			continue
-		}
-		if user, ok := models.ActiveUsers.Get(user); ok {
-			user.Conn.WriteJSON(req)
+	if parent != nil {
+		preview := quote(parent)
+		if err := setAuthors([]bson.M{preview}, "userId"); err != nil {
+			return nil, err
 		}
+		req["quoted"] = preview
 	}
 
-	c.JSON(200, req)
+	ws.Hub.SendToUsers(following, id, ws.Event{Type: "msg", Payload: req})
+	if models.ActiveRoom.SetTyping(roomId, id, time.Time{}) {
+		sendTyping(roomId, id, login, false)
+	}
+	return req, nil
+}
+
+// EditMessage replaces the text of a message with the text form field. Only
+// the author can edit, as long as they may post in the room, and deleted
+// messages can't be edited.
+func EditMessage(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+	room, msg, ok := roomMessage(c, roomActionPost)
+	if !ok {
+		return
+	}
+	if err := checkRoomPost(room, principal.Id); err != nil {
+		abortRoomError(c, err)
+		return
+	}
+	if intValue(msg["userId"]) != principal.Id {
+		c.String(403, "forbidden")
+		return
+	}
+	text := c.PostForm("text")
+	if text == "" {
+		c.String(400, "invalid form field")
+		return
+	}
+
+	now := timestamp()
+	coll := database.MI.DB.Collection("messages")
+	filter := bson.M{"_id": msg["_id"], "deleted": bson.M{"$ne": true}}
+	update := bson.M{"$set": bson.M{"text": text, "edited": true, "updatedAt": now}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated bson.M
+	err := coll.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "message not found")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	msgId := idToHex(msg["_id"])
+	ws.Hub.SendToUsers(room.Users, principal.Id, ws.Event{
+		Type: "msg.edited",
+		Payload: map[string]interface{}{
+			"type":      "msg.edited",
+			"roomId":    room.Id,
+			"messageId": msgId,
+			"text":      text,
+			"updatedAt": now,
+		},
+	})
+
+	updated["_id"] = msgId
+	setReactions(updated, principal.Id)
+	c.JSON(200, updated)
+}
+
+// DeleteMessage deletes a message of a room. Authors can delete their
+// messages and room admins any message. The message is kept as a tombstone
+// without its content so that pages, pointers and replies stay stable.
+func DeleteMessage(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+	room, msg, ok := roomMessage(c, roomActionPost)
+	if !ok {
+		return
+	}
+	if intValue(msg["userId"]) != principal.Id && !models.RoomRoleAtLeast(room.Roles[principal.Id], models.RoomAdmin) {
+		c.String(403, "forbidden")
+		return
+	}
+	if deleted, _ := msg["deleted"].(bool); deleted {
+		c.Status(204)
+		return
+	}
+
+	now := timestamp()
+	coll := database.MI.DB.Collection("messages")
+	update := bson.M{
+		"$set":   bson.M{"deleted": true, "deletedBy": principal.Id, "updatedAt": now},
+		"$unset": bson.M{"text": "", "images": "", "files": "", "reactions": "", "edited": ""},
+	}
+	if _, err := coll.UpdateOne(context.Background(), bson.M{"_id": msg["_id"]}, update); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	removeUploads(attachmentPaths(msg))
+
+	ws.Hub.SendToUsers(room.Users, principal.Id, ws.Event{
+		Type: "msg.deleted",
+		Payload: map[string]interface{}{
+			"type":      "msg.deleted",
+			"roomId":    room.Id,
+			"messageId": idToHex(msg["_id"]),
+			"deletedBy": principal.Id,
+		},
+	})
+
+	c.Status(204)
+}
+
+// roomMessage loads the room of the :id param and its message :msgId for a
+// member of the room, answering the request otherwise.
+func roomMessage(c *gin.Context, action string) (models.Room, bson.M, bool) {
+	principal := auth.GetPrincipal(c)
+
+	roomId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return models.Room{}, nil, false
+	}
+	msgId, err := primitive.ObjectIDFromHex(c.Param("msgId"))
+	if err != nil {
+		c.String(400, "invalid param")
+		return models.Room{}, nil, false
+	}
+
+	room, err := loadRoom(roomId)
+	if err == nil && room.Roles[principal.Id] == "" {
+		err = denyRoom(roomId, principal.Id, action)
+	}
+	if err != nil {
+		abortRoomError(c, err)
+		return room, nil, false
+	}
+
+	coll := database.MI.DB.Collection("messages")
+	var msg bson.M
+	err = coll.FindOne(context.Background(), bson.M{"_id": msgId, "roomId": roomId}).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "message not found")
+		return room, nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return room, nil, false
+	}
+	return room, msg, true
 }
 
 func getRoomUsers(roomId int) ([]int, error) {
@@ -100,18 +273,8 @@ func getRoomUsers(roomId int) ([]int, error) {
 }
 
 func GetMessages(c *gin.Context) {
-	token, err := c.Cookie("token")
-	if err != nil {
-		log.Println(err)
-		c.String(400, "no token")
-		return
-	}
-	userId, _, err := auth.TokenCredentials(token)
-	if err != nil {
-		log.Println(err)
-		c.String(400, "invalid credentials")
-		return
-	}
+	principal := auth.GetPrincipal(c)
+	userId := principal.Id
 
 	roomId, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -120,93 +283,55 @@ func GetMessages(c *gin.Context) {
 		return
 	}
 
-	res, err := getMsgs(roomId)
+	q, err := parsePageQuery(c, directionAsc)
 	if err != nil {
-		log.Println(err)
-		c.String(500, "internal error")
+		c.String(400, "invalid param")
 		return
 	}
-
-	count, err := countPosts("messages", "roomId", roomId)
-	if err != nil {
-		log.Println(err)
-		c.String(500, "internal error")
+	if _, _, err := checkMember(roomId, userId, roomActionRead); err != nil {
+		abortRoomError(c, err)
 		return
 	}
 
-	conn := database.PostgreConn
-	_, err = conn.Exec(context.Background(), "update read_msg set count=$1 where user_id=$2 and room_id=$3", count, userId, roomId)
+	res, err := getMsgs(roomId, q)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
 
-	for _, msg := range res {
-		var login string
-		err := conn.QueryRow(context.Background(), "select login from users where id=$1", msg["userId"]).Scan(&login)
+	if id, _, ok := newestDoc(res.Items); ok {
+		err = markMessages(userId, principal.Login, roomId, id, receiptRead)
 		if err != nil {
-			continue
+			log.Println(err)
+			c.String(500, "internal error")
+			return
 		}
-		msg["login"] = login
 	}
 
-	c.JSON(200, res)
-}
-
-func GetMissedMsg(c *gin.Context) {
-	token, err := c.Cookie("token")
-	if err != nil {
+	for _, msg := range res.Items {
+		setReactions(msg, userId)
+	}
+	if err := setQuotes(res.Items); err != nil {
 		log.Println(err)
-		c.String(400, "no token")
+		c.String(500, "internal error")
 		return
 	}
-	id, _, err := auth.TokenCredentials(token)
-	if err != nil {
+	if err := setReplyCounts(res.Items); err != nil {
 		log.Println(err)
-		c.String(400, "invalid creadentials")
+		c.String(500, "internal error")
 		return
 	}
-
-	var rooms []int
-
-	conn := database.PostgreConn
-	rows, err := conn.Query(context.Background(), "select room_id from urooms where user_id=$1", id)
-	if err != nil {
+	if err := setReceipts(res.Items, roomId, userId); err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
+		return
 	}
 
-	for rows.Next() {
-		var roomId int
-		err := rows.Scan(&roomId)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		rooms = append(rooms, roomId)
-	}
-
-	res := make(map[int]int)
-
-	for _, roomId := range rooms {
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		count, err := countPosts("messages", "roomId", roomId)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		conn := database.PostgreConn
-		var readNum int
-		row := conn.QueryRow(context.Background(), "select count from read_msg where user_id=$1 and room_id=$2", id, roomId)
-		if err := row.Scan(&readNum); err != nil {
-			log.Println(err)
-			continue
-		}
-		res[roomId] = int(count) - readNum
+	if err := setAuthors(res.Items, "userId"); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
 	}
 
 	c.JSON(200, res)
@@ -223,10 +348,13 @@ func getRoomById(id int) (string, error) {
 }
 
 func generateMsgRequest(text string, id, roomId int, images, files []string) bson.M {
+	now := timestamp()
 	req := bson.M{
-		"text":   text,
-		"userId": id,
-		"roomId": roomId,
+		"text":      text,
+		"userId":    id,
+		"roomId":    roomId,
+		"createdAt": now,
+		"updatedAt": now,
 	}
 	if len(images) != 0 {
 		req["images"] = images
@@ -238,23 +366,37 @@ func generateMsgRequest(text string, id, roomId int, images, files []string) bso
 	return req
 }
 
-func getMsgs(id int) ([]bson.M, error) {
-	coll := database.MI.DB.Collection("messages")
-	var res []bson.M
-	cursor, err := coll.Find(context.Background(), bson.D{{"roomId", id}})
+// setReceipts adds to the messages of the user the members that received and
+// read them.
+func setReceipts(msgs []bson.M, roomId, userId int) error {
+	members, err := getReceipts(roomId)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	for cursor.Next(context.Background()) {
-		var post bson.M
-		err := cursor.Decode(&post)
-		if err != nil {
-			log.Println(err)
+	for _, msg := range msgs {
+		createdAt, ok := msg["createdAt"].(primitive.DateTime)
+		if !ok || intValue(msg["userId"]) != userId {
 			continue
 		}
-		res = append(res, post)
+		at, id := createdAt.Time(), idToHex(msg["_id"])
+		deliveredTo, readBy := []int{}, []int{}
+		for _, member := range members {
+			if member.UserId == userId {
+				continue
+			}
+			if member.Delivered.covers(at, id) {
+				deliveredTo = append(deliveredTo, member.UserId)
+			}
+			if member.Read.covers(at, id) {
+				readBy = append(readBy, member.UserId)
+			}
+		}
+		msg["deliveredTo"] = deliveredTo
+		msg["readBy"] = readBy
 	}
+	return nil
+}
 
-	return res, nil
+func getMsgs(id int, q pageQuery) (page, error) {
+	return findPage("messages", bson.M{"roomId": id}, q)
 }
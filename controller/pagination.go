@@ -0,0 +1,223 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"social-media/database"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+const (
+	directionAsc  = "asc"
+	directionDesc = "desc"
+)
+
+// page is the response of paginated endpoints. Next is the cursor of the
+// older items and Prev the one of the newer items; they are passed back as
+// ?before=<next> and ?after=<prev> and are empty when there is nothing more
+// in that direction.
+type page struct {
+	Items []bson.M `json:"items"`
+	Next  string   `json:"next,omitempty"`
+	Prev  string   `json:"prev,omitempty"`
+}
+
+// pageQuery selects a page of documents ordered by createdAt, with the
+// ObjectID breaking ties. Without a cursor the newest documents are returned.
+// Since and until limit the createdAt range. Direction only decides the order
+// of the items within the page.
+type pageQuery struct {
+	before    *primitive.ObjectID
+	after     *primitive.ObjectID
+	since     *time.Time
+	until     *time.Time
+	limit     int
+	direction string
+}
+
+var errPageQuery = errors.New("invalid pagination params")
+
+// parsePageQuery reads before, after, since, until, limit and direction from
+// the query string. Times are RFC 3339. defaultDirection is used when
+// direction isn't given.
+func parsePageQuery(c *gin.Context, defaultDirection string) (pageQuery, error) {
+	q := pageQuery{
+		limit:     defaultPageLimit,
+		direction: c.DefaultQuery("direction", defaultDirection),
+	}
+	if q.direction != directionAsc && q.direction != directionDesc {
+		return q, errPageQuery
+	}
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return q, errPageQuery
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		q.limit = limit
+	}
+
+	before, after := c.Query("before"), c.Query("after")
+	if before != "" && after != "" {
+		return q, errPageQuery
+	}
+	if before != "" {
+		id, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			return q, errPageQuery
+		}
+		q.before = &id
+	}
+	if after != "" {
+		id, err := primitive.ObjectIDFromHex(after)
+		if err != nil {
+			return q, errPageQuery
+		}
+		q.after = &id
+	}
+
+	for param, dst := range map[string]**time.Time{"since": &q.since, "until": &q.until} {
+		if raw := c.Query(param); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return q, errPageQuery
+			}
+			*dst = &t
+		}
+	}
+	return q, nil
+}
+
+// findPage loads one page of the documents of a collection matching filter.
+func findPage(collection string, filter bson.M, q pageQuery) (page, error) {
+	coll := database.MI.DB.Collection(collection)
+
+	var cursorTime time.Time
+	if cursorId := q.cursor(); cursorId != nil {
+		var err error
+		cursorTime, err = createdAt(coll, *cursorId)
+		if err != nil {
+			return page{}, err
+		}
+	}
+	pageFilter(filter, q, cursorTime)
+
+	sort := -1
+	if q.after != nil {
+		sort = 1
+	}
+	sortKeys := bson.D{{Key: "createdAt", Value: sort}, {Key: "_id", Value: sort}}
+	opts := options.Find().SetSort(sortKeys).SetLimit(int64(q.limit + 1))
+	cursor, err := coll.Find(context.Background(), filter, opts)
+	if err != nil {
+		return page{}, err
+	}
+	docs := []bson.M{}
+	if err := cursor.All(context.Background(), &docs); err != nil {
+		return page{}, err
+	}
+
+	more := len(docs) > q.limit
+	if more {
+		docs = docs[:q.limit]
+	}
+	if sort == 1 {
+		reverse(docs)
+	}
+
+	res := page{Items: docs}
+	if len(docs) != 0 {
+		newest, oldest := idToHex(docs[0]["_id"]), idToHex(docs[len(docs)-1]["_id"])
+		if q.after != nil {
+			res.Next = oldest
+			if more {
+				res.Prev = newest
+			}
+		} else {
+			if more {
+				res.Next = oldest
+			}
+			if q.before != nil {
+				res.Prev = newest
+			}
+		}
+	}
+	if q.direction == directionAsc {
+		reverse(res.Items)
+	}
+	return res, nil
+}
+
+// cursor returns the document the page continues from, nil for the first
+// page.
+func (q pageQuery) cursor() *primitive.ObjectID {
+	if q.after != nil {
+		return q.after
+	}
+	return q.before
+}
+
+// pageFilter narrows filter to the createdAt range of the query and to the
+// documents past its cursor, which was created at cursorTime.
+func pageFilter(filter bson.M, q pageQuery, cursorTime time.Time) {
+	created := bson.M{}
+	if q.since != nil {
+		created["$gte"] = *q.since
+	}
+	if q.until != nil {
+		created["$lt"] = *q.until
+	}
+	if len(created) != 0 {
+		filter["createdAt"] = created
+	}
+
+	cursorId := q.cursor()
+	if cursorId == nil {
+		return
+	}
+	op := "$lt"
+	if q.after != nil {
+		op = "$gt"
+	}
+	filter["$or"] = bson.A{
+		bson.M{"createdAt": bson.M{op: cursorTime}},
+		bson.M{"createdAt": cursorTime, "_id": bson.M{op: *cursorId}},
+	}
+}
+
+// createdAt returns the creation time of the cursor document. If it has been
+// deleted meanwhile, the time encoded in its ObjectID is close enough.
+func createdAt(coll *mongo.Collection, id primitive.ObjectID) (time.Time, error) {
+	var doc struct {
+		CreatedAt time.Time `bson:"createdAt"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"createdAt": 1})
+	err := coll.FindOne(context.Background(), bson.M{"_id": id}, opts).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return id.Timestamp(), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return doc.CreatedAt, nil
+}
+
+func reverse(docs []bson.M) {
+	for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+		docs[i], docs[j] = docs[j], docs[i]
+	}
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func queryContext(query string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/?"+query, nil)
+	return c
+}
+
+func TestParsePageQuery(t *testing.T) {
+	id := primitive.NewObjectID()
+	since := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		query     string
+		direction string
+		want      pageQuery
+		err       bool
+	}{
+		{name: "defaults", direction: directionDesc, want: pageQuery{limit: defaultPageLimit, direction: directionDesc}},
+		{name: "default direction", direction: directionAsc, want: pageQuery{limit: defaultPageLimit, direction: directionAsc}},
+		{name: "direction", query: "direction=asc", direction: directionDesc, want: pageQuery{limit: defaultPageLimit, direction: directionAsc}},
+		{name: "limit", query: "limit=5", direction: directionDesc, want: pageQuery{limit: 5, direction: directionDesc}},
+		{name: "limit capped", query: "limit=1000", direction: directionDesc, want: pageQuery{limit: maxPageLimit, direction: directionDesc}},
+		{name: "before", query: "before=" + id.Hex(), direction: directionDesc, want: pageQuery{before: &id, limit: defaultPageLimit, direction: directionDesc}},
+		{name: "after", query: "after=" + id.Hex(), direction: directionDesc, want: pageQuery{after: &id, limit: defaultPageLimit, direction: directionDesc}},
+		{name: "since", query: "since=2023-05-01T12:00:00Z", direction: directionDesc, want: pageQuery{since: &since, limit: defaultPageLimit, direction: directionDesc}},
+		{name: "unknown direction", query: "direction=up", direction: directionDesc, err: true},
+		{name: "zero limit", query: "limit=0", direction: directionDesc, err: true},
+		{name: "bad limit", query: "limit=ten", direction: directionDesc, err: true},
+		{name: "bad cursor", query: "before=123", direction: directionDesc, err: true},
+		{name: "both cursors", query: "before=" + id.Hex() + "&after=" + id.Hex(), direction: directionDesc, err: true},
+		{name: "bad time", query: "until=yesterday", direction: directionDesc, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parsePageQuery(queryContext(tt.query), tt.direction)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %+v, want error", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("got %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+	at := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	until := at.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		q    pageQuery
+		want bson.M
+	}{
+		{name: "first page", q: pageQuery{}, want: bson.M{"roomId": 1}},
+		{name: "range", q: pageQuery{since: &at, until: &until}, want: bson.M{
+			"roomId":    1,
+			"createdAt": bson.M{"$gte": at, "$lt": until},
+		}},
+		{name: "before", q: pageQuery{before: &id}, want: bson.M{
+			"roomId": 1,
+			"$or": bson.A{
+				bson.M{"createdAt": bson.M{"$lt": at}},
+				bson.M{"createdAt": at, "_id": bson.M{"$lt": id}},
+			},
+		}},
+		{name: "after", q: pageQuery{after: &id}, want: bson.M{
+			"roomId": 1,
+			"$or": bson.A{
+				bson.M{"createdAt": bson.M{"$gt": at}},
+				bson.M{"createdAt": at, "_id": bson.M{"$gt": id}},
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := bson.M{"roomId": 1}
+			pageFilter(filter, tt.q, at)
+			if !reflect.DeepEqual(filter, tt.want) {
+				t.Errorf("got %v, want %v", filter, tt.want)
+			}
+		})
+	}
+}
@@ -2,32 +2,29 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"log"
 	"mime/multipart"
+	"net/http"
+	"os"
 	"path/filepath"
 	"social-media/auth"
 	"social-media/database"
-	"social-media/models"
+	"social-media/ws"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func PostMessage(c *gin.Context) {
-	token, err := c.Cookie("token")
-	if err != nil {
-		log.Println(err)
-		c.String(400, "no token")
-		return
-	}
-	id, login, err := auth.TokenCredentials(token)
-	if err != nil {
-		log.Println(err)
-		c.String(400, "invalid credentials")
-		return
-	}
+	principal := auth.GetPrincipal(c)
+	id, login := principal.Id, principal.Login
 	text := c.PostForm("text")
 	form, err := c.MultipartForm()
 	if err != nil {
@@ -59,7 +56,7 @@ func PostMessage(c *gin.Context) {
 	}
 
 	postId := idToHex(result.InsertedID)
-	following, err := getFollowingIds(id)
+	followers, err := followersOf(id)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
@@ -70,159 +67,449 @@ func PostMessage(c *gin.Context) {
 	req["login"] = login
 	req["type"] = "post"
 
-	for _, user := range following {
-		if user, ok := models.ActiveUsers.Get(user); ok {
-			user.Conn.WriteJSON(req)
-		}
-	}
+	ws.Hub.SendToUsers(followers, 0, ws.Event{Type: "post", Payload: req})
 
 	c.JSON(200, req)
 }
 
+// processFormFiles saves the uploaded files of a form field under the
+// directory of the user. Each file gets a unique prefix so that uploads with
+// the same name never share a path. On failure the files saved so far are
+// removed.
 func processFormFiles(form *multipart.Form, c *gin.Context, key string, id int) ([]string, error) {
 	filesPath := []string{}
 	files := form.File[key]
 	for _, file := range files {
-		filename := filepath.Base(file.Filename)
+		filename := primitive.NewObjectID().Hex() + "-" + filepath.Base(file.Filename)
 		path := strconv.Itoa(id) + "/" + filename
-		filesPath = append(filesPath, path)
 		if err := c.SaveUploadedFile(file, "./upload/"+path); err != nil {
+			removeUploads(filesPath)
 			return nil, err
 		}
+		filesPath = append(filesPath, path)
 	}
 	return filesPath, nil
 }
 
+// ChangeMessage edits a post of the caller. Only the fields sent are
+// changed: "text" replaces the text, uploaded "images[]" and "files[]" are
+// added and "removeImages[]" and "removeFiles[]" drop attachments by path.
+// The previous version is kept in the post_history collection.
 func ChangeMessage(c *gin.Context) {
-	token, err := c.Cookie("token")
+	userId := auth.GetPrincipal(c).Id
+	rawId := c.PostForm("id")
+	id, err := primitive.ObjectIDFromHex(rawId)
 	if err != nil {
 		log.Println(err)
-		c.String(400, "no token")
+		c.String(400, "invalid param")
+		return
+	}
+
+	coll := database.MI.DB.Collection("posts")
+	var post bson.M
+	err = coll.FindOne(context.Background(), bson.M{"_id": id}).Decode(&post)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "not found")
 		return
 	}
-	login, _, err := auth.TokenCredentials(token)
 	if err != nil {
 		log.Println(err)
-		c.String(400, "invalid credentials")
+		c.String(500, "internal error")
 		return
 	}
-	rawId := c.PostForm("id")
-	id, err := primitive.ObjectIDFromHex(rawId)
+	if intValue(post["userId"]) != userId {
+		c.String(403, "forbidden")
+		return
+	}
+
+	var newImages, newFiles []string
+	form, err := c.MultipartForm()
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		log.Println(err)
+		c.String(400, "invalid form param")
+		return
+	}
+	if form != nil {
+		newImages, err = processFormFiles(form, c, "images[]", userId)
+		if err != nil {
+			log.Println(err)
+			c.String(400, "upload file err")
+			return
+		}
+		newFiles, err = processFormFiles(form, c, "files[]", userId)
+		if err != nil {
+			removeUploads(newImages)
+			log.Println(err)
+			c.String(400, "upload file err")
+			return
+		}
+	}
+	// The new files are only kept once the post references them.
+	saved := false
+	defer func() {
+		if !saved {
+			removeUploads(append(newImages, newFiles...))
+		}
+	}()
+
+	update := bson.M{}
+	if text, ok := c.GetPostForm("text"); ok && text != post["text"] {
+		update["text"] = text
+	}
+	if images, changed := editAttachments(post["images"], c.PostFormArray("removeImages[]"), newImages); changed {
+		update["images"] = images
+	}
+	if files, changed := editAttachments(post["files"], c.PostFormArray("removeFiles[]"), newFiles); changed {
+		update["files"] = files
+	}
+	if len(update) == 0 {
+		c.JSON(200, post)
+		return
+	}
+
+	edited := timestamp()
+	history := bson.M{
+		"postId":     rawId,
+		"userId":     userId,
+		"text":       post["text"],
+		"images":     post["images"],
+		"files":      post["files"],
+		"edited":     post["edited"],
+		"replacedAt": edited,
+	}
+	historyColl := database.MI.DB.Collection("post_history")
+	inserted, err := historyColl.InsertOne(context.Background(), history)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
-	text := c.PostForm("text")
-	image := []string{}
-	files := []string{}
-
-	req := generatePostRequest(text, login, image, files)
 
-	coll := database.MI.DB.Collection("posts")
-	_, err = coll.UpdateByID(context.Background(), id, bson.D{{"$set", req}})
+	update["edited"] = edited
+	update["updatedAt"] = edited
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = coll.FindOneAndUpdate(context.Background(), bson.M{"_id": id, "userId": userId}, bson.M{"$set": update}, opts).Decode(&post)
 	if err != nil {
 		log.Println(err)
+		if _, err := historyColl.DeleteOne(context.Background(), bson.M{"_id": inserted.InsertedID}); err != nil {
+			log.Println(err)
+		}
 		c.String(500, "internal error")
+		return
 	}
+	saved = true
+
+	c.JSON(200, post)
 }
 
-func GetNPosts(c *gin.Context) {
-	token, err := c.Cookie("token")
+// DeletePost removes a post together with its comments, edit history and
+// uploaded files. Authors can delete their posts, moderators any post.
+func DeletePost(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+	rawId := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(rawId)
 	if err != nil {
 		log.Println(err)
-		c.String(400, "no token")
+		c.String(400, "invalid param")
+		return
+	}
+
+	coll := database.MI.DB.Collection("posts")
+	var post bson.M
+	err = coll.FindOne(context.Background(), bson.M{"_id": id}).Decode(&post)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "not found")
 		return
 	}
-	id, _, err := auth.TokenCredentials(token)
 	if err != nil {
-		c.String(400, "invalid credentials")
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	authorId := intValue(post["userId"])
+	if authorId != principal.Id && !principal.HasScope(auth.ScopeModeratePosts) {
+		c.String(403, "forbidden")
 		return
 	}
 
-	res, err := getPosts(id)
-	if err != nil {
+	if _, err := coll.DeleteOne(context.Background(), bson.M{"_id": id}); err != nil {
+		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
 
-	c.JSON(200, res)
+	uploads := attachmentPaths(post)
+	for _, collection := range []string{"comments", "post_history"} {
+		paths, err := deleteByPostId(collection, rawId)
+		if err != nil {
+			log.Println(err)
+			c.String(500, "internal error")
+			return
+		}
+		uploads = append(uploads, paths...)
+	}
+
+	removeUploads(uploads)
+
+	c.Status(204)
 }
 
-func GetOtherPosts(c *gin.Context) {
-	login := c.Param("login")
-	id, err := getIdByLogin(login)
+// deleteByPostId removes the documents of a collection that belong to a post
+// and returns the paths of the files attached to them.
+func deleteByPostId(collection, postId string) ([]string, error) {
+	return deleteByFilter(collection, bson.M{"postId": postId})
+}
+
+// deleteByFilter removes the documents of a collection matching filter and
+// returns the paths of the files attached to them.
+func deleteByFilter(collection string, filter bson.M) ([]string, error) {
+	coll := database.MI.DB.Collection(collection)
+	cursor, err := coll.Find(context.Background(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err := cursor.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	if _, err := coll.DeleteMany(context.Background(), filter); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, doc := range docs {
+		paths = append(paths, attachmentPaths(doc)...)
+	}
+	return paths, nil
+}
+
+func attachmentPaths(doc bson.M) []string {
+	var paths []string
+	for _, key := range []string{"images", "files"} {
+		list, _ := doc[key].(bson.A)
+		for _, item := range list {
+			if path, ok := item.(string); ok {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// uploadCollections are the collections whose documents attach uploads.
+var uploadCollections = []string{"posts", "comments", "messages", "post_history"}
+
+// removeUploads deletes files saved by processFormFiles once no document
+// references them anymore. Uploads made before names were unique can be
+// shared, so paths still in use are kept. Failures are only logged since the
+// documents that owned the files are already gone.
+func removeUploads(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	inUse, err := referencedUploads(paths)
 	if err != nil {
 		log.Println(err)
-		c.String(500, "internal error")
 		return
 	}
 
-	token, err := c.Cookie("token")
+	removed := make(map[string]bool)
+	for _, path := range paths {
+		if removed[path] || inUse[path] {
+			continue
+		}
+		removed[path] = true
+		clean := filepath.Clean(path)
+		if filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+			continue
+		}
+		if err := os.Remove(filepath.Join("./upload", clean)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println(err)
+		}
+	}
+}
+
+// referencedUploads returns which of the paths are still attached to a
+// document.
+func referencedUploads(paths []string) (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	filter := bson.M{"$or": bson.A{
+		bson.M{"images": bson.M{"$in": paths}},
+		bson.M{"files": bson.M{"$in": paths}},
+	}}
+	opts := options.Find().SetProjection(bson.M{"images": 1, "files": 1})
+	for _, collection := range uploadCollections {
+		cursor, err := database.MI.DB.Collection(collection).Find(context.Background(), filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		var docs []bson.M
+		if err := cursor.All(context.Background(), &docs); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			for _, path := range attachmentPaths(doc) {
+				inUse[path] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// GetPostHistory returns the previous versions of a post, newest first. Only
+// the author and moderators can see them.
+func GetPostHistory(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+	postId := c.Param("id")
+	id, err := primitive.ObjectIDFromHex(postId)
 	if err != nil {
-		log.Println(err)
-		c.String(400, "no token")
+		c.String(400, "invalid param")
+		return
+	}
+
+	var post struct {
+		UserId int `bson:"userId"`
+	}
+	postOpts := options.FindOne().SetProjection(bson.M{"userId": 1})
+	err = database.MI.DB.Collection("posts").FindOne(context.Background(), bson.M{"_id": id}, postOpts).Decode(&post)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "not found")
 		return
 	}
-	customerId, _, err := auth.TokenCredentials(token)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
+	if post.UserId != principal.Id && !principal.HasScope(auth.ScopeModeratePosts) {
+		c.String(403, "forbidden")
+		return
+	}
 
-	posts, err := getPosts(id)
+	coll := database.MI.DB.Collection("post_history")
+	opts := options.Find().SetSort(bson.D{{Key: "replacedAt", Value: -1}})
+	cursor, err := coll.Find(context.Background(), bson.M{"postId": postId}, opts)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
 
-	num, err := countPosts("posts", "userId", id)
-	if err != nil {
+	res := []bson.M{}
+	if err := cursor.All(context.Background(), &res); err != nil {
+		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
 
-	conn := database.PostgreConn
-	_, err = conn.Exec(context.Background(), "update followers set read=$1 where user_id=$2 and follower_id=$3", num, id, customerId)
+	c.JSON(200, res)
+}
+
+// editAttachments removes the given paths from a stored attachment list and
+// appends the new ones. It reports whether the list changed.
+func editAttachments(stored interface{}, remove, add []string) ([]string, bool) {
+	res := []string{}
+	changed := false
+	list, _ := stored.(bson.A)
+	for _, item := range list {
+		path, _ := item.(string)
+		if containsString(remove, path) {
+			changed = true
+			continue
+		}
+		res = append(res, path)
+	}
+	if len(add) != 0 {
+		res = append(res, add...)
+		changed = true
+	}
+	return res, changed
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// intValue reads a number decoded from Mongo, which stores Go ints as int32
+// or int64 depending on their size.
+func intValue(v interface{}) int {
+	switch v := v.(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+func GetNPosts(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+	q, err := parsePageQuery(c, directionAsc)
+	if err != nil {
+		c.String(400, "invalid param")
+		return
+	}
+
+	res, err := getPosts(id, q)
 	if err != nil {
-		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
 
-	c.JSON(200, posts)
+	c.JSON(200, res)
 }
 
-func countPosts(collection, key string, value int) (int64, error) {
-	coll := database.MI.DB.Collection(collection)
-	filter := bson.M{key: value}
-	count, err := coll.CountDocuments(context.Background(), filter)
+func GetOtherPosts(c *gin.Context) {
+	login := c.Param("login")
+	id, err := getIdByLogin(login)
 	if err != nil {
-		return 0, err
+		log.Println(err)
+		c.String(500, "internal error")
+		return
 	}
-	return count, nil
-}
 
-func getPosts(id int) ([]bson.M, error) {
-	coll := database.MI.DB.Collection("posts")
-	var res []bson.M
-	cursor, err := coll.Find(context.Background(), bson.D{{"userId", id}})
+	customerId := auth.GetPrincipal(c).Id
+	q, err := parsePageQuery(c, directionAsc)
 	if err != nil {
-		return nil, err
+		c.String(400, "invalid param")
+		return
 	}
 
-	for cursor.Next(context.Background()) {
-		var post bson.M
-		err := cursor.Decode(&post)
-		if err != nil {
+	posts, err := getPosts(id, q)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	if postId, createdAt, ok := newestDoc(posts.Items); ok {
+		if err := markPostsSeen(customerId, id, postId, createdAt); err != nil {
 			log.Println(err)
+			c.String(500, "internal error")
+			return
 		}
-		res = append(res, post)
 	}
 
-	return res, nil
+	c.JSON(200, posts)
+}
+
+func getPosts(id int, q pageQuery) (page, error) {
+	return findPage("posts", bson.M{"userId": id}, q)
+}
+
+// timestamp returns the current time at the precision Mongo stores dates
+// with, so responses match what is read back later.
+func timestamp() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
 }
 
 func idToHex(res interface{}) string {
@@ -233,10 +520,13 @@ func idToHex(res interface{}) string {
 }
 
 func generatePostRequest(text string, id int, images, files []string) bson.M {
+	now := timestamp()
 	req := bson.M{
-		"text":     text,
-		"userId":   id,
-		"comments": bson.A{},
+		"text":      text,
+		"userId":    id,
+		"comments":  bson.A{},
+		"createdAt": now,
+		"updatedAt": now,
 	}
 	if len(images) != 0 {
 		req["images"] = images
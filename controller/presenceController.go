@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"social-media/auth"
+	"social-media/database"
+	"social-media/models"
+	"social-media/ws"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// typingTTL is how long a typing notice lasts unless the client renews it.
+const typingTTL = 6 * time.Second
+
+// maxPresenceLogins is how many users GetPresence answers for at once.
+const maxPresenceLogins = 100
+
+type presence struct {
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// GetPresence returns the presence of the users listed in ?logins=a,b,c.
+func GetPresence(c *gin.Context) {
+	logins := splitLogins(c.Query("logins"))
+	if len(logins) > maxPresenceLogins {
+		c.String(400, "too many logins")
+		return
+	}
+
+	conn := database.PostgreConn
+	rows, err := conn.Query(context.Background(), "select id, login, last_seen from users where login = any($1)", logins)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	defer rows.Close()
+
+	res := make(map[string]presence)
+	for rows.Next() {
+		var id int
+		var login string
+		var lastSeen *time.Time
+		if err := rows.Scan(&id, &login, &lastSeen); err != nil {
+			log.Println(err)
+			continue
+		}
+		p := presence{Status: presenceOf(id)}
+		if p.Status == models.PresenceOffline {
+			p.LastSeen = lastSeen
+		}
+		res[login] = p
+	}
+
+	c.JSON(200, res)
+}
+
+func presenceOf(id int) string {
+	if !ws.Hub.Online(id) {
+		return models.PresenceOffline
+	}
+	if status, _ := models.ActiveUsers.Presence(id); status == models.PresenceAway {
+		return models.PresenceAway
+	}
+	return models.PresenceOnline
+}
+
+// broadcastPresence tells the room members and followers of a user that its
+// presence changed.
+func broadcastPresence(id int, login, status string) {
+	audience, err := presenceAudience(id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ws.Hub.SendToUsers(audience, id, ws.Event{
+		Type: "presence",
+		Payload: map[string]interface{}{
+			"type":   "presence",
+			"userId": id,
+			"login":  login,
+			"status": status,
+		},
+	})
+}
+
+// presenceAudience returns the users sharing a room with the user and the
+// user's followers.
+func presenceAudience(id int) ([]int, error) {
+	conn := database.PostgreConn
+	rows, err := conn.Query(context.Background(), `select user_id from urooms where room_id in (select room_id from urooms where user_id=$1)
+		union select follower_id from followers where user_id=$1`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []int
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		users = append(users, userId)
+	}
+	return users, rows.Err()
+}
+
+// userOnline is called when the first connection of a user opens.
+func userOnline(id int, login string) {
+	broadcastPresence(id, login, models.PresenceOnline)
+}
+
+// userOffline is called when the last connection of a user closes.
+func userOffline(id int, login string) {
+	conn := database.PostgreConn
+	if _, err := conn.Exec(context.Background(), "update users set last_seen=now() where id=$1", id); err != nil {
+		log.Println(err)
+	}
+	for _, roomId := range models.ActiveRoom.ClearTyping(id) {
+		sendTyping(roomId, id, login, false)
+	}
+	broadcastPresence(id, login, models.PresenceOffline)
+}
+
+type presencePayload struct {
+	Status string `json:"status"`
+}
+
+// wsPresence lets a client report the user as away or back online.
+func wsPresence(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+	var payload presencePayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, ws.NewError(ws.ErrBadRequest, "status is required")
+	}
+	if payload.Status != models.PresenceOnline && payload.Status != models.PresenceAway {
+		return nil, ws.NewError(ws.ErrBadRequest, "status must be online or away")
+	}
+	if models.ActiveUsers.SetPresence(client.UserId, payload.Status) {
+		broadcastPresence(client.UserId, client.Login, payload.Status)
+	}
+	return payload, nil
+}
+
+type typingPayload struct {
+	RoomId int   `json:"roomId"`
+	Typing *bool `json:"typing"`
+}
+
+// wsTyping marks the user as typing in a room, or not typing anymore when
+// typing is false, and tells the members that have the room open.
+func wsTyping(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+	var payload typingPayload
+	if err := json.Unmarshal(raw, &payload); err != nil || payload.RoomId == 0 {
+		return nil, ws.NewError(ws.ErrBadRequest, "roomId is required")
+	}
+	if _, _, err := checkMember(payload.RoomId, client.UserId, roomActionPost); err != nil {
+		return nil, wsRoomError(err)
+	}
+
+	typing := payload.Typing == nil || *payload.Typing
+	var until time.Time
+	if typing {
+		until = time.Now().Add(typingTTL)
+	}
+	models.ActiveRoom.SetTyping(payload.RoomId, client.UserId, until)
+	sendTyping(payload.RoomId, client.UserId, client.Login, typing)
+	return nil, nil
+}
+
+func sendTyping(roomId, userId int, login string, typing bool) {
+	members, err := getRoomUsers(roomId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ws.Hub.SendToSubscribers(roomId, members, userId, ws.Event{
+		Type: "typing",
+		Payload: map[string]interface{}{
+			"type":      "typing",
+			"roomId":    roomId,
+			"userId":    userId,
+			"login":     login,
+			"typing":    typing,
+			"expiresIn": typingTTL.Milliseconds(),
+		},
+	})
+}
+
+// GetTyping returns the users typing in a room.
+func GetTyping(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+
+	roomId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return
+	}
+	if _, _, err := checkMember(roomId, principal.Id, roomActionRead); err != nil {
+		abortRoomError(c, err)
+		return
+	}
+	c.JSON(200, models.ActiveRoom.Typing(roomId))
+}
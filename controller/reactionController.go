@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"social-media/auth"
+	"social-media/database"
+	"social-media/ws"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxEmojiLength = 16
+
+// reaction is the aggregate of one emoji on a message as returned to clients.
+type reaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Mine    bool   `json:"mine"`
+	UserIds []int  `json:"userIds"`
+}
+
+// AddReaction reacts to a message with the emoji form field. A user reacts
+// at most once with each emoji. In read-only rooms only admins react.
+func AddReaction(c *gin.Context) {
+	changeReaction(c, c.PostForm("emoji"), "$addToSet", "added")
+}
+
+// RemoveReaction takes back the :emoji reaction of the user.
+func RemoveReaction(c *gin.Context) {
+	changeReaction(c, c.Param("emoji"), "$pull", "removed")
+}
+
+func changeReaction(c *gin.Context, emoji, op, action string) {
+	principal := auth.GetPrincipal(c)
+	if !validEmoji(emoji) {
+		c.String(400, "invalid emoji")
+		return
+	}
+	room, msg, ok := roomMessage(c, roomActionPost)
+	if !ok {
+		return
+	}
+	if err := checkRoomPost(room, principal.Id); err != nil {
+		abortRoomError(c, err)
+		return
+	}
+
+	// $addToSet compares whole documents, so the field order has to be fixed.
+	entry := bson.D{{Key: "emoji", Value: emoji}, {Key: "userId", Value: principal.Id}}
+	coll := database.MI.DB.Collection("messages")
+	filter := bson.M{"_id": msg["_id"], "deleted": bson.M{"$ne": true}}
+	update := bson.M{op: bson.M{"reactions": entry}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated bson.M
+	err := coll.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "message not found")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	reactions := aggregateReactions(updated, 0)
+	ws.Hub.SendToUsers(room.Users, principal.Id, ws.Event{
+		Type: "msg.reaction",
+		Payload: map[string]interface{}{
+			"type":      "msg.reaction",
+			"action":    action,
+			"roomId":    room.Id,
+			"messageId": idToHex(msg["_id"]),
+			"emoji":     emoji,
+			"userId":    principal.Id,
+			"reactions": reactions,
+		},
+	})
+
+	c.JSON(200, aggregateReactions(updated, principal.Id))
+}
+
+func validEmoji(emoji string) bool {
+	return emoji != "" && utf8.RuneCountInString(emoji) <= maxEmojiLength && !strings.ContainsAny(emoji, " \t\n")
+}
+
+// setReactions replaces the reactions stored in a message with their
+// aggregates.
+func setReactions(msg bson.M, userId int) {
+	if _, ok := msg["reactions"]; ok {
+		msg["reactions"] = aggregateReactions(msg, userId)
+	}
+}
+
+// aggregateReactions counts the reactions of a message per emoji, in the
+// order the emojis were first used. Mine is set for the reactions of userId.
+func aggregateReactions(msg bson.M, userId int) []reaction {
+	res := []reaction{}
+	index := make(map[string]int)
+	list, _ := msg["reactions"].(bson.A)
+	for _, item := range list {
+		var emoji string
+		var reactor int
+		switch entry := item.(type) {
+		case bson.D:
+			m := entry.Map()
+			emoji, _ = m["emoji"].(string)
+			reactor = intValue(m["userId"])
+		case bson.M:
+			emoji, _ = entry["emoji"].(string)
+			reactor = intValue(entry["userId"])
+		default:
+			continue
+		}
+
+		i, ok := index[emoji]
+		if !ok {
+			i = len(res)
+			index[emoji] = i
+			res = append(res, reaction{Emoji: emoji})
+		}
+		res[i].Count++
+		res[i].UserIds = append(res[i].UserIds, reactor)
+		if reactor == userId {
+			res[i].Mine = true
+		}
+	}
+	return res
+}
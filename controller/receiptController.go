@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"social-media/auth"
+	"social-media/database"
+	"social-media/ws"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+)
+
+var (
+	errNoMessage = errors.New("message not found in room")
+	errNotMember = errors.New("not a member of the room")
+)
+
+type receipts struct {
+	UserId    int       `json:"userId"`
+	Login     string    `json:"login"`
+	Delivered watermark `json:"delivered"`
+	Read      watermark `json:"read"`
+}
+
+// GetReceipts returns the delivered and read pointers of the members of a
+// room.
+func GetReceipts(c *gin.Context) {
+	userId := auth.GetPrincipal(c).Id
+
+	roomId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return
+	}
+
+	res, err := getReceipts(roomId)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	member := false
+	for _, r := range res {
+		if r.UserId == userId {
+			member = true
+		}
+	}
+	if !member {
+		abortRoomError(c, denyRoom(roomId, userId, roomActionRead))
+		return
+	}
+
+	c.JSON(200, res)
+}
+
+// ReadMessages moves the read pointer of the user in a room up to the message
+// given in the messageId form field.
+func ReadMessages(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+
+	roomId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(c.PostForm("messageId"))
+	if err != nil {
+		c.String(400, "invalid form field")
+		return
+	}
+
+	err = markMessages(principal.Id, principal.Login, roomId, msgId, receiptRead)
+	if errors.Is(err, errNotMember) {
+		c.String(403, "not a member of the room")
+		return
+	}
+	if errors.Is(err, errNoMessage) {
+		c.String(404, "message not found")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.Status(204)
+}
+
+func getReceipts(roomId int) ([]receipts, error) {
+	conn := database.PostgreConn
+	rows, err := conn.Query(context.Background(), `select users.id, users.login, read_msg.last_delivered, read_msg.last_delivered_at, read_msg.last_read, read_msg.last_read_at
+		from read_msg join users on users.id=read_msg.user_id where read_msg.room_id=$1`, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []receipts{}
+	for rows.Next() {
+		var r receipts
+		var delivered, read *string
+		if err := rows.Scan(&r.UserId, &r.Login, &delivered, &r.Delivered.At, &read, &r.Read.At); err != nil {
+			return nil, err
+		}
+		if delivered != nil {
+			r.Delivered.Id = *delivered
+		}
+		if read != nil {
+			r.Read.Id = *read
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// markMessages moves the delivered or read pointer of a member forward to a
+// message and tells the senders of the messages it passed. Reading a message
+// also delivers it. Pointers never move back.
+func markMessages(userId int, login string, roomId int, msgId primitive.ObjectID, status string) error {
+	var msg struct {
+		CreatedAt time.Time `bson:"createdAt"`
+	}
+	coll := database.MI.DB.Collection("messages")
+	opts := options.FindOne().SetProjection(bson.M{"createdAt": 1})
+	err := coll.FindOne(context.Background(), bson.M{"_id": msgId, "roomId": roomId}, opts).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errNoMessage
+	}
+	if err != nil {
+		return err
+	}
+
+	prev, err := advancePointer(userId, roomId, msgId.Hex(), msg.CreatedAt, status)
+	if err != nil || prev == nil {
+		return err
+	}
+
+	filter := bson.M{"$and": bson.A{
+		prev.after("roomId", roomId),
+		bson.M{"userId": bson.M{"$ne": userId}, "createdAt": bson.M{"$lte": msg.CreatedAt}},
+	}}
+	senders, err := coll.Distinct(context.Background(), "userId", filter)
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for _, sender := range senders {
+		ids = append(ids, intValue(sender))
+	}
+	ws.Hub.SendToUsers(ids, userId, ws.Event{
+		Type: "receipt",
+		Payload: map[string]interface{}{
+			"type":      "receipt",
+			"status":    status,
+			"roomId":    roomId,
+			"userId":    userId,
+			"login":     login,
+			"messageId": msgId.Hex(),
+			"createdAt": msg.CreatedAt,
+		},
+	})
+	return nil
+}
+
+// advancePointer stores the new pointer if it is ahead of the current one and
+// returns the pointer it replaced, or nil when nothing changed.
+func advancePointer(userId, roomId int, msgId string, createdAt time.Time, status string) (*watermark, error) {
+	conn := database.PostgreConn
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var delivered, read watermark
+	var deliveredId, readId *string
+	err = tx.QueryRow(context.Background(), `select last_delivered, last_delivered_at, last_read, last_read_at
+		from read_msg where user_id=$1 and room_id=$2 for update`, userId, roomId).Scan(&deliveredId, &delivered.At, &readId, &read.At)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deliveredId != nil {
+		delivered.Id = *deliveredId
+	}
+	if readId != nil {
+		read.Id = *readId
+	}
+
+	prev := delivered
+	if status == receiptRead {
+		if read.covers(createdAt, msgId) {
+			return nil, nil
+		}
+		_, err = tx.Exec(context.Background(), "update read_msg set last_read=$1, last_read_at=$2 where user_id=$3 and room_id=$4", msgId, createdAt, userId, roomId)
+		if err != nil {
+			return nil, err
+		}
+		prev = read
+	} else if delivered.covers(createdAt, msgId) {
+		return nil, nil
+	}
+	if !delivered.covers(createdAt, msgId) {
+		_, err = tx.Exec(context.Background(), "update read_msg set last_delivered=$1, last_delivered_at=$2 where user_id=$3 and room_id=$4", msgId, createdAt, userId, roomId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &prev, tx.Commit(context.Background())
+}
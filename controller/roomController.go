@@ -2,88 +2,625 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"log"
 	"social-media/auth"
 	"social-media/database"
 	"social-media/models"
+	"social-media/ws"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	errNoRoom   = errors.New("room not found")
+	errReadOnly = errors.New("only admins can post in the room")
 )
 
 func NewRoom(c *gin.Context) {
-	token, err := c.Cookie("token")
+	principal := auth.GetPrincipal(c)
+
+	name := c.PostForm("name")
+	userIds := []int{principal.Id}
+	for _, login := range splitLogins(c.PostForm("users")) {
+		userId, err := getIdByLogin(login)
+		if err != nil {
+			continue
+		}
+		if !containsInt(userIds, userId) {
+			userIds = append(userIds, userId)
+		}
+	}
+
+	var roomId int
+	_, err := withTx(func(tx pgx.Tx) ([]int, error) {
+		err := tx.QueryRow(context.Background(), "insert into rooms (name, owner_id, kind) values ($1, $2, $3) returning id", name, principal.Id, roomGroup).Scan(&roomId)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := addMembers(tx, roomId, userIds); err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(context.Background(), "update urooms set role=$1 where room_id=$2 and user_id=$3", models.RoomOwner, roomId, principal.Id)
+		return nil, err
+	})
 	if err != nil {
 		log.Println(err)
-		c.String(400, "no token")
+		c.String(500, "internal error")
 		return
 	}
-	_, login, err := auth.TokenCredentials(token)
+
+	room := models.Room{
+		Id:      roomId,
+		Name:    name,
+		OwnerId: principal.Id,
+		Users:   userIds,
+		Roles:   make(map[int]string),
+	}
+	for _, userId := range userIds {
+		room.Roles[userId] = models.RoomMember
+	}
+	room.Roles[principal.Id] = models.RoomOwner
+	syncRoom(room)
+	notifyRoom(room.Users, principal.Id, "created", room, nil)
+
+	c.JSON(200, room)
+}
+
+// roomView is a room as listed by GetRooms. Direct rooms are named after
+// the counterpart and carry its profile.
+type roomView struct {
+	models.Room
+	Counterpart *author `json:"counterpart,omitempty"`
+}
+
+func GetRooms(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+	conn := database.PostgreConn
+	rows, err := conn.Query(context.Background(), `select rooms.id, rooms.name, rooms.owner_id, rooms.read_only, rooms.kind,
+		(select user_id from urooms other where other.room_id=rooms.id and other.user_id<>$1 limit 1)
+		from rooms join urooms on rooms.id=urooms.room_id where urooms.user_id=$1`, id)
 	if err != nil {
-		c.String(400, "invalid credentials")
+		log.Println(err)
+		c.String(500, "internal error")
 		return
 	}
+	defer rows.Close()
 
-	name := c.PostForm("name")
-	list := c.PostForm("users")
-	users := strings.Split(list, ", ")
-	users = append(users, login)
+	rooms := []roomView{}
+	counterparts := make(map[int]int)
+	var counterpartIds []int
+	for rows.Next() {
+		var room models.Room
+		var ownerId, otherId *int
+		var kind string
+		if err = rows.Scan(&room.Id, &room.Name, &ownerId, &room.ReadOnly, &kind, &otherId); err != nil {
+			continue
+		}
+		if ownerId != nil {
+			room.OwnerId = *ownerId
+		}
+		room.Direct = kind == roomDirect
+		if room.Direct && otherId != nil {
+			counterparts[room.Id] = *otherId
+			counterpartIds = append(counterpartIds, *otherId)
+		}
+		rooms = append(rooms, roomView{Room: room})
+	}
 
-	var roomId int
+	authors, err := getAuthors(counterpartIds)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	for i := range rooms {
+		if a, ok := authors[counterparts[rooms[i].Id]]; ok {
+			rooms[i].Name = a.Login
+			rooms[i].Counterpart = &a
+		}
+	}
 
-	conn := database.PostgreConn
-	conn.QueryRow(context.Background(), "insert into rooms (name) values ($1) returning id", name).Scan(&roomId)
+	c.JSON(200, rooms)
+}
+
+// InviteMembers adds the users of the comma separated users form field to a
+// room. Admins can invite.
+func InviteMembers(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok || !requireRoomRole(c, room, principal.Id, models.RoomAdmin) {
+		return
+	}
 
 	var userIds []int
-	for _, user := range users {
-		userId, err := getIdByLogin(user)
+	for _, login := range splitLogins(c.PostForm("users")) {
+		userId, err := getIdByLogin(login)
 		if err != nil {
-			continue
+			c.String(404, "user not found")
+			return
 		}
-		conn.Exec(context.Background(), "insert into urooms (room_id, user_id) values ($1, $2)", roomId, userId)
-		conn.Exec(context.Background(), "insert into read_msg (room_id, user_id, count) values ($1, $2, $3)", roomId, userId, 0)
 		userIds = append(userIds, userId)
 	}
+	if len(userIds) == 0 {
+		c.String(400, "invalid form field")
+		return
+	}
 
-	room := &models.Room{
-		Id:    roomId,
-		Name:  name,
-		Users: userIds,
+	added, err := withTx(func(tx pgx.Tx) ([]int, error) {
+		return addMembers(tx, room.Id, userIds)
+	})
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	room.Users = append(room.Users, added...)
+	for _, userId := range added {
+		room.Roles[userId] = models.RoomMember
 	}
-	models.ActiveRoom.Set(roomId, room)
+	syncRoom(room)
+	notifyRoom(room.Users, principal.Id, "members_added", room, map[string]interface{}{"userIds": added})
 
 	c.JSON(200, room)
 }
 
-func GetRooms(c *gin.Context) {
-	token, err := c.Cookie("token")
-	if err != nil {
+// RemoveMember removes a user from a room. Admins can remove members and
+// only the owner can remove admins; users leave through LeaveRoom.
+func RemoveMember(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok || !requireRoomRole(c, room, principal.Id, models.RoomAdmin) {
+		return
+	}
+
+	userId, ok := memberByLogin(c, room, c.Param("login"))
+	if !ok {
+		return
+	}
+	if userId == principal.Id {
+		c.String(400, "use leave to leave the room")
+		return
+	}
+	if models.RoomRoleAtLeast(room.Roles[userId], room.Roles[principal.Id]) {
+		c.String(403, "forbidden")
+		return
+	}
+
+	if err := leave(room, userId, principal.Id); err != nil {
 		log.Println(err)
-		c.String(400, "no token")
+		c.String(500, "internal error")
+		return
+	}
+
+	c.Status(204)
+}
+
+// LeaveRoom removes the user from a room. The owner has to transfer the room
+// first, unless it is the last member, in which case the room is deleted.
+func LeaveRoom(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok {
+		return
+	}
+
+	if len(room.Users) == 1 {
+		if err := deleteRoom(room, principal.Id); err != nil {
+			log.Println(err)
+			c.String(500, "internal error")
+			return
+		}
+		c.Status(204)
+		return
+	}
+	if room.OwnerId == principal.Id {
+		c.String(409, "transfer the room before leaving")
+		return
+	}
+
+	if err := leave(room, principal.Id, principal.Id); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.Status(204)
+}
+
+// RenameRoom changes the name of a room. Admins can rename.
+func RenameRoom(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok || !requireRoomRole(c, room, principal.Id, models.RoomAdmin) {
 		return
 	}
-	id, _, err := auth.TokenCredentials(token)
+	name := c.PostForm("name")
+	if name == "" {
+		c.String(400, "invalid form field")
+		return
+	}
+
+	conn := database.PostgreConn
+	if _, err := conn.Exec(context.Background(), "update rooms set name=$1 where id=$2", name, room.Id); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	room.Name = name
+	syncRoom(room)
+	notifyRoom(room.Users, principal.Id, "renamed", room, nil)
+
+	c.JSON(200, room)
+}
+
+// TransferRoom makes another member the owner of a room. The previous owner
+// stays as an admin.
+func TransferRoom(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok || !requireRoomRole(c, room, principal.Id, models.RoomOwner) {
+		return
+	}
+
+	ownerId, ok := memberByLogin(c, room, c.PostForm("login"))
+	if !ok {
+		return
+	}
+	if ownerId == principal.Id {
+		c.String(400, "invalid form field")
+		return
+	}
+
+	_, err := withTx(func(tx pgx.Tx) ([]int, error) {
+		if _, err := tx.Exec(context.Background(), "update rooms set owner_id=$1 where id=$2", ownerId, room.Id); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(context.Background(), "update urooms set role=$1 where room_id=$2 and user_id=$3", models.RoomAdmin, room.Id, principal.Id); err != nil {
+			return nil, err
+		}
+		_, err := tx.Exec(context.Background(), "update urooms set role=$1 where room_id=$2 and user_id=$3", models.RoomOwner, room.Id, ownerId)
+		return nil, err
+	})
 	if err != nil {
 		log.Println(err)
-		c.String(400, "invalid credentials")
+		c.String(500, "internal error")
+		return
+	}
+
+	room.OwnerId = ownerId
+	room.Roles[principal.Id] = models.RoomAdmin
+	room.Roles[ownerId] = models.RoomOwner
+	syncRoom(room)
+	notifyRoom(room.Users, principal.Id, "owner_changed", room, nil)
+
+	c.JSON(200, room)
+}
+
+// DeleteRoom deletes a room with its messages. Only the owner can delete it.
+func DeleteRoom(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok || !requireRoomRole(c, room, principal.Id, models.RoomOwner) {
+		return
+	}
+
+	if err := deleteRoom(room, principal.Id); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.Status(204)
+}
+
+// SetMemberRole makes a member an admin or a plain member again, from the
+// role form field. Only the owner can change roles.
+func SetMemberRole(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok || !requireRoomRole(c, room, principal.Id, models.RoomOwner) {
 		return
 	}
+
+	role := c.PostForm("role")
+	if !models.ValidRoomRole(role) || role == models.RoomOwner {
+		c.String(400, "invalid role")
+		return
+	}
+	userId, ok := memberByLogin(c, room, c.Param("login"))
+	if !ok {
+		return
+	}
+	if userId == principal.Id {
+		c.String(400, "the owner's role changes through a transfer")
+		return
+	}
+
 	conn := database.PostgreConn
-	rows, err := conn.Query(context.Background(), "select id, name from rooms join urooms on rooms.id=urooms.room_id where user_id=$1", id)
+	_, err := conn.Exec(context.Background(), "update urooms set role=$1 where room_id=$2 and user_id=$3", role, room.Id, userId)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
 		return
 	}
 
-	var rooms []models.Room
+	room.Roles[userId] = role
+	syncRoom(room)
+	notifyRoom(room.Users, principal.Id, "role_changed", room, map[string]interface{}{"userId": userId, "role": role})
+
+	c.JSON(200, room)
+}
+
+// UpdateRoomSettings changes the settings of a room given as form fields.
+// readOnly=true turns the room into an announcement channel where only admins
+// can post. Admins can change settings.
+func UpdateRoomSettings(c *gin.Context) {
+	room, principal, ok := roomOfMember(c)
+	if !ok || !requireRoomRole(c, room, principal.Id, models.RoomAdmin) {
+		return
+	}
+
+	if raw, ok := c.GetPostForm("readOnly"); ok {
+		readOnly, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.String(400, "invalid form field")
+			return
+		}
+		room.ReadOnly = readOnly
+	}
+
+	conn := database.PostgreConn
+	if _, err := conn.Exec(context.Background(), "update rooms set read_only=$1 where id=$2", room.ReadOnly, room.Id); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	syncRoom(room)
+	notifyRoom(room.Users, principal.Id, "settings_changed", room, nil)
+
+	c.JSON(200, room)
+}
+
+// roomOfMember loads the room of the :id param for a management action and
+// checks the user is one of its members and it isn't a direct room, answering
+// the request otherwise.
+func roomOfMember(c *gin.Context) (models.Room, *auth.Principal, bool) {
+	principal := auth.GetPrincipal(c)
+
+	roomId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return models.Room{}, nil, false
+	}
+
+	room, err := loadRoom(roomId)
+	if errors.Is(err, errNoRoom) {
+		c.String(404, "room not found")
+		return room, nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return room, nil, false
+	}
+	if !containsInt(room.Users, principal.Id) {
+		abortRoomError(c, denyRoom(roomId, principal.Id, roomActionManage))
+		return room, nil, false
+	}
+	if room.Direct {
+		c.String(400, "direct message rooms can't be changed")
+		return room, nil, false
+	}
+	return room, principal, true
+}
+
+// requireRoomRole checks the user has at least the given role in the room,
+// answering the request otherwise.
+func requireRoomRole(c *gin.Context, room models.Room, userId int, role string) bool {
+	if !models.RoomRoleAtLeast(room.Roles[userId], role) {
+		c.String(403, "forbidden")
+		return false
+	}
+	return true
+}
+
+// memberByLogin returns the id of a member of the room, answering the request
+// when the login isn't one.
+func memberByLogin(c *gin.Context, room models.Room, login string) (int, bool) {
+	userId, err := getIdByLogin(login)
+	if err != nil || !containsInt(room.Users, userId) {
+		c.String(404, "member not found")
+		return 0, false
+	}
+	return userId, true
+}
+
+func loadRoom(roomId int) (models.Room, error) {
+	room := models.Room{Id: roomId, Roles: make(map[int]string)}
+	var ownerId *int
+	var kind string
+	conn := database.PostgreConn
+	err := conn.QueryRow(context.Background(), "select name, owner_id, read_only, kind from rooms where id=$1", roomId).Scan(&room.Name, &ownerId, &room.ReadOnly, &kind)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return room, errNoRoom
+	}
+	if err != nil {
+		return room, err
+	}
+	if ownerId != nil {
+		room.OwnerId = *ownerId
+	}
+	room.Direct = kind == roomDirect
+
+	rows, err := conn.Query(context.Background(), "select user_id, role from urooms where room_id=$1", roomId)
+	if err != nil {
+		return room, err
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var room models.Room
-		if err = rows.Scan(&room.Id, &room.Name); err != nil {
+		var userId int
+		var role string
+		if err := rows.Scan(&userId, &role); err != nil {
+			return room, err
+		}
+		room.Users = append(room.Users, userId)
+		room.Roles[userId] = role
+	}
+	return room, rows.Err()
+}
+
+// checkPost returns why the user can't post in the room, if it can't.
+func checkPost(roomId, userId int) error {
+	role, readOnly, err := checkMember(roomId, userId, roomActionPost)
+	if err != nil {
+		return err
+	}
+	if readOnly && !models.RoomRoleAtLeast(role, models.RoomAdmin) {
+		return errReadOnly
+	}
+	return nil
+}
+
+// checkRoomPost is checkPost for a room already loaded. Editing messages and
+// reacting count as posting.
+func checkRoomPost(room models.Room, userId int) error {
+	if room.ReadOnly && !models.RoomRoleAtLeast(room.Roles[userId], models.RoomAdmin) {
+		return errReadOnly
+	}
+	return nil
+}
+
+// addMembers adds users to a room, skipping the ones already in it, and
+// returns the users that were added. New members start reading from now on.
+func addMembers(tx pgx.Tx, roomId int, userIds []int) ([]int, error) {
+	var added []int
+	for _, userId := range userIds {
+		tag, err := tx.Exec(context.Background(), `insert into urooms (room_id, user_id) select $1, $2
+			where not exists (select 1 from urooms where room_id=$1 and user_id=$2)`, roomId, userId)
+		if err != nil {
+			return nil, err
+		}
+		if tag.RowsAffected() == 0 {
 			continue
 		}
-		rooms = append(rooms, room)
+		_, err = tx.Exec(context.Background(), "insert into read_msg (room_id, user_id, count, last_read_at, last_delivered_at) values ($1, $2, 0, now(), now())", roomId, userId)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, userId)
 	}
+	return added, nil
+}
 
-	c.JSON(200, rooms)
+// leave removes a member from a room and tells the members, the removed one
+// included.
+func leave(room models.Room, userId, by int) error {
+	_, err := withTx(func(tx pgx.Tx) ([]int, error) {
+		if _, err := tx.Exec(context.Background(), "delete from urooms where room_id=$1 and user_id=$2", room.Id, userId); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(context.Background(), "delete from read_msg where room_id=$1 and user_id=$2", room.Id, userId); err != nil {
+			return nil, err
+		}
+		_, err := tx.Exec(context.Background(), "delete from read_thread where room_id=$1 and user_id=$2", room.Id, userId)
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	audience := room.Users
+	var users []int
+	for _, user := range room.Users {
+		if user != userId {
+			users = append(users, user)
+		}
+	}
+	room.Users = users
+	delete(room.Roles, userId)
+	syncRoom(room)
+	notifyRoom(audience, by, "member_removed", room, map[string]interface{}{"userId": userId})
+	return nil
+}
+
+// deleteRoom removes a room, its memberships and its messages.
+func deleteRoom(room models.Room, by int) error {
+	_, err := withTx(func(tx pgx.Tx) ([]int, error) {
+		for _, query := range []string{
+			"delete from urooms where room_id=$1",
+			"delete from read_msg where room_id=$1",
+			"delete from read_thread where room_id=$1",
+			"delete from rooms where id=$1",
+		} {
+			if _, err := tx.Exec(context.Background(), query, room.Id); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	models.ActiveRoom.Delete(room.Id)
+
+	uploads, err := deleteByFilter("messages", bson.M{"roomId": room.Id})
+	if err != nil {
+		return err
+	}
+	removeUploads(uploads)
+
+	notifyRoom(room.Users, by, "deleted", room, nil)
+	return nil
+}
+
+func withTx(fn func(pgx.Tx) ([]int, error)) ([]int, error) {
+	tx, err := database.PostgreConn.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	res, err := fn(tx)
+	if err != nil {
+		return nil, err
+	}
+	return res, tx.Commit(context.Background())
+}
+
+// syncRoom updates the cached room, or drops it when none of its members is
+// connected anymore.
+func syncRoom(room models.Room) {
+	for _, userId := range room.Users {
+		if ws.Hub.Online(userId) {
+			models.ActiveRoom.Update(room)
+			return
+		}
+	}
+	models.ActiveRoom.Delete(room.Id)
+}
+
+// notifyRoom pushes a room change to users, skipping the one who made it.
+func notifyRoom(users []int, skip int, action string, room models.Room, extra map[string]interface{}) {
+	payload := map[string]interface{}{
+		"type":   "room",
+		"action": action,
+		"room":   room,
+	}
+	for key, value := range extra {
+		payload[key] = value
+	}
+	ws.Hub.SendToUsers(users, skip, ws.Event{Type: "room", Payload: payload})
+}
+
+// splitLogins splits a comma separated list of logins.
+func splitLogins(list string) []string {
+	var logins []string
+	for _, login := range strings.Split(list, ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			logins = append(logins, login)
+		}
+	}
+	return logins
 }
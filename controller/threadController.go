@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"social-media/auth"
+	"social-media/database"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// quoteLength is how many characters of the parent a reply quotes.
+const quoteLength = 200
+
+// threadPage is a page of the replies of a thread with the message that
+// started it and the number of replies the user still hasn't read once the
+// page is marked read.
+type threadPage struct {
+	page
+	Root   bson.M `json:"root"`
+	Unread int    `json:"unread"`
+}
+
+// GetThread returns the thread the message :msgId of the room :id belongs
+// to, paginated like GetMessages, and marks it read.
+func GetThread(c *gin.Context) {
+	principal := auth.GetPrincipal(c)
+
+	roomId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.String(400, "invalid param")
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(c.Param("msgId"))
+	if err != nil {
+		c.String(400, "invalid param")
+		return
+	}
+	q, err := parsePageQuery(c, directionAsc)
+	if err != nil {
+		c.String(400, "invalid param")
+		return
+	}
+	if _, _, err := checkMember(roomId, principal.Id, roomActionRead); err != nil {
+		abortRoomError(c, err)
+		return
+	}
+
+	coll := database.MI.DB.Collection("messages")
+	var msg bson.M
+	err = coll.FindOne(context.Background(), bson.M{"_id": msgId, "roomId": roomId}).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.String(404, "message not found")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	rootId := threadRoot(msg)
+	var root bson.M
+	if err := coll.FindOne(context.Background(), bson.M{"_id": rootId}).Decode(&root); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	res := threadPage{Root: root}
+	res.page, err = findPage("messages", bson.M{"roomId": roomId, "threadId": rootId}, q)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	if id, createdAt, ok := newestDoc(res.Items); ok {
+		if err := markThreadRead(principal.Id, roomId, rootId, id, createdAt); err != nil {
+			log.Println(err)
+			c.String(500, "internal error")
+			return
+		}
+	}
+
+	seen, err := threadWatermark(principal.Id, rootId)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	filter := seen.after("roomId", roomId)
+	filter["threadId"] = rootId
+	filter["userId"] = bson.M{"$ne": principal.Id}
+	filter["deleted"] = bson.M{"$ne": true}
+	unread, err := coll.CountDocuments(context.Background(), filter)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	res.Unread = int(unread)
+
+	docs := append([]bson.M{root}, res.Items...)
+	for _, doc := range docs {
+		setReactions(doc, principal.Id)
+	}
+	if err := setQuotes(res.Items); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if err := setReplyCounts([]bson.M{root}); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if err := setAuthors(docs, "userId"); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, res)
+}
+
+// replyParent loads the message a new message replies to, given its hex id.
+// There is no parent when the id is empty.
+func replyParent(roomId int, rawId string) (bson.M, error) {
+	if rawId == "" {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(rawId)
+	if err != nil {
+		return nil, errNoMessage
+	}
+
+	var parent bson.M
+	coll := database.MI.DB.Collection("messages")
+	err = coll.FindOne(context.Background(), bson.M{"_id": id, "roomId": roomId, "deleted": bson.M{"$ne": true}}).Decode(&parent)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errNoMessage
+	}
+	return parent, err
+}
+
+// threadRoot returns the id of the message that started the thread of msg.
+// A message that isn't a reply is the root of its own thread.
+func threadRoot(msg bson.M) primitive.ObjectID {
+	if root, ok := msg["threadId"].(primitive.ObjectID); ok {
+		return root
+	}
+	id, _ := msg["_id"].(primitive.ObjectID)
+	return id
+}
+
+// quote returns the preview of a message shown above its replies.
+func quote(msg bson.M) bson.M {
+	preview := bson.M{
+		"_id":    msg["_id"],
+		"userId": msg["userId"],
+	}
+	if deleted, _ := msg["deleted"].(bool); deleted {
+		preview["deleted"] = true
+		return preview
+	}
+	text, _ := msg["text"].(string)
+	if runes := []rune(text); len(runes) > quoteLength {
+		text = string(runes[:quoteLength]) + "…"
+	}
+	preview["text"] = text
+	if len(attachmentPaths(msg)) != 0 {
+		preview["attachments"] = true
+	}
+	return preview
+}
+
+// setQuotes embeds the preview of the parent of each reply, loading all the
+// parents in one query.
+func setQuotes(msgs []bson.M) error {
+	var ids bson.A
+	for _, msg := range msgs {
+		if id, ok := msg["replyTo"].(primitive.ObjectID); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	coll := database.MI.DB.Collection("messages")
+	opts := options.Find().SetProjection(bson.M{"reactions": 0})
+	cursor, err := coll.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return err
+	}
+	var parents []bson.M
+	if err := cursor.All(context.Background(), &parents); err != nil {
+		return err
+	}
+
+	quotes := make(map[primitive.ObjectID]bson.M)
+	var previews []bson.M
+	for _, parent := range parents {
+		preview := quote(parent)
+		quotes[parent["_id"].(primitive.ObjectID)] = preview
+		previews = append(previews, preview)
+	}
+	if err := setAuthors(previews, "userId"); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if id, ok := msg["replyTo"].(primitive.ObjectID); ok {
+			if preview, ok := quotes[id]; ok {
+				msg["quoted"] = preview
+			} else {
+				msg["quoted"] = bson.M{"_id": id, "deleted": true}
+			}
+		}
+	}
+	return nil
+}
+
+// setReplyCounts adds the number of replies in the thread of each message
+// that started one, counted in one aggregation.
+func setReplyCounts(msgs []bson.M) error {
+	var ids bson.A
+	for _, msg := range msgs {
+		if _, reply := msg["threadId"]; !reply {
+			ids = append(ids, msg["_id"])
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"threadId": bson.M{"$in": ids}, "deleted": bson.M{"$ne": true}}},
+		bson.M{"$group": bson.M{"_id": "$threadId", "count": bson.M{"$sum": 1}}},
+	}
+	cursor, err := database.MI.DB.Collection("messages").Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return err
+	}
+	var counts []struct {
+		Id    primitive.ObjectID `bson:"_id"`
+		Count int                `bson:"count"`
+	}
+	if err := cursor.All(context.Background(), &counts); err != nil {
+		return err
+	}
+
+	replies := make(map[primitive.ObjectID]int)
+	for _, count := range counts {
+		replies[count.Id] = count.Count
+	}
+	for _, msg := range msgs {
+		if id, ok := msg["_id"].(primitive.ObjectID); ok {
+			if count, ok := replies[id]; ok {
+				msg["replyCount"] = count
+			}
+		}
+	}
+	return nil
+}
+
+func threadWatermark(userId int, rootId primitive.ObjectID) (watermark, error) {
+	var seen watermark
+	var seenId *string
+	conn := database.PostgreConn
+	err := conn.QueryRow(context.Background(), "select last_read, last_read_at from read_thread where user_id=$1 and thread_id=$2",
+		userId, rootId.Hex()).Scan(&seenId, &seen.At)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return seen, nil
+	}
+	if seenId != nil {
+		seen.Id = *seenId
+	}
+	return seen, err
+}
+
+// markThreadRead moves the watermark of the user in a thread forward to a
+// reply. It never moves back.
+func markThreadRead(userId, roomId int, rootId, msgId primitive.ObjectID, createdAt time.Time) error {
+	conn := database.PostgreConn
+	_, err := conn.Exec(context.Background(), `insert into read_thread (user_id, room_id, thread_id, last_read, last_read_at) values ($1, $2, $3, $4, $5)
+		on conflict (user_id, thread_id) do update set last_read=excluded.last_read, last_read_at=excluded.last_read_at
+		where (read_thread.last_read_at, read_thread.last_read) < (excluded.last_read_at, excluded.last_read)`,
+		userId, roomId, rootId.Hex(), msgId.Hex(), createdAt)
+	return err
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestThreadRoot(t *testing.T) {
+	id, root := primitive.NewObjectID(), primitive.NewObjectID()
+
+	tests := []struct {
+		name string
+		msg  bson.M
+		want primitive.ObjectID
+	}{
+		{name: "root", msg: bson.M{"_id": id}, want: id},
+		{name: "reply", msg: bson.M{"_id": id, "threadId": root}, want: root},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := threadRoot(tt.msg); got != tt.want {
+				t.Errorf("got %s, want %s", got.Hex(), tt.want.Hex())
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	id := primitive.NewObjectID()
+	long := strings.Repeat("é", quoteLength+1)
+
+	tests := []struct {
+		name string
+		msg  bson.M
+		want bson.M
+	}{
+		{
+			name: "text",
+			msg:  bson.M{"_id": id, "userId": 1, "text": "hello", "roomId": 2},
+			want: bson.M{"_id": id, "userId": 1, "text": "hello"},
+		},
+		{
+			name: "long text",
+			msg:  bson.M{"_id": id, "userId": 1, "text": long},
+			want: bson.M{"_id": id, "userId": 1, "text": long[:len(long)-len("é")] + "…"},
+		},
+		{
+			name: "attachments",
+			msg:  bson.M{"_id": id, "userId": 1, "images": bson.A{"1/a.png"}},
+			want: bson.M{"_id": id, "userId": 1, "text": "", "attachments": true},
+		},
+		{
+			name: "deleted",
+			msg:  bson.M{"_id": id, "userId": 1, "deleted": true},
+			want: bson.M{"_id": id, "userId": 1, "deleted": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quote(tt.msg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"social-media/auth"
+	"social-media/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RefreshToken(c *gin.Context) {
+	refreshToken := c.PostForm("refreshToken")
+	if refreshToken == "" {
+		cookie, err := c.Cookie(auth.RefreshCookie)
+		if err != nil {
+			log.Println(err)
+			c.String(400, "no refresh token")
+			return
+		}
+		refreshToken = cookie
+	}
+
+	pair, err := auth.RefreshSession(refreshToken)
+	if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+		log.Println(err)
+		c.String(401, "invalid refresh token")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	auth.SetSessionCookies(c, pair)
+	c.JSON(200, pair)
+}
+
+// Logout revokes the access tokens and the refresh tokens of the device of
+// the request, and closes the WebSockets the device opened.
+func Logout(c *gin.Context) {
+	claims := auth.GetPrincipal(c).Claims
+	if claims == nil {
+		c.String(400, "no token")
+		return
+	}
+
+	if err := auth.RevokeToken(claims); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if claims.Session != "" {
+		if err := auth.RevokeFamily(claims.Session); err != nil {
+			log.Println(err)
+			c.String(500, "internal error")
+			return
+		}
+		if err := auth.RevokeSession(claims.Session); err != nil {
+			log.Println(err)
+			c.String(500, "internal error")
+			return
+		}
+		ws.Hub.DisconnectSession(claims.ID, claims.Session, ws.CloseLoggedOut, "logged out")
+	}
+
+	auth.ClearSessionCookies(c)
+	c.Status(204)
+}
+
+// LogoutAll revokes every access and refresh token of the user.
+func LogoutAll(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+
+	if err := auth.RevokeUserRefreshTokens(id); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	if err := auth.RevokeUser(id); err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+	ws.Hub.Disconnect(id, ws.CloseLoggedOut, "logged out")
+
+	auth.ClearSessionCookies(c)
+	c.Status(204)
+}
+
+// GetJWKS publishes the public signing keys for services that verify our
+// tokens offline.
+func GetJWKS(c *gin.Context) {
+	c.JSON(200, auth.PublicKeys())
+}
@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"context"
+	"log"
+	"social-media/auth"
+	"social-media/database"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// watermark points at the newest document a user has seen in a stream, the
+// posts of an author or the messages of a room. Documents are ordered by
+// createdAt with the ObjectID breaking ties, as in findPage, so deleting
+// documents never moves a watermark.
+type watermark struct {
+	Id string     `json:"id,omitempty"`
+	At *time.Time `json:"at,omitempty"`
+}
+
+// covers reports whether the document is at or before the watermark.
+func (w watermark) covers(createdAt time.Time, id string) bool {
+	if w.At == nil {
+		return false
+	}
+	if !createdAt.Equal(*w.At) {
+		return createdAt.Before(*w.At)
+	}
+	return id <= w.Id
+}
+
+// after matches the documents of a stream newer than the watermark. The
+// stream is selected by key, userId for posts and roomId for messages.
+func (w watermark) after(key string, value int) bson.M {
+	filter := bson.M{key: value}
+	if w.At != nil {
+		id, err := primitive.ObjectIDFromHex(w.Id)
+		if err != nil {
+			filter["createdAt"] = bson.M{"$gt": *w.At}
+			return filter
+		}
+		filter["$or"] = bson.A{
+			bson.M{"createdAt": bson.M{"$gt": *w.At}},
+			bson.M{"createdAt": *w.At, "_id": bson.M{"$gt": id}},
+		}
+	}
+	return filter
+}
+
+// newestDoc returns the id and creation time of the latest document of a
+// page.
+func newestDoc(docs []bson.M) (primitive.ObjectID, time.Time, bool) {
+	var newest watermark
+	for _, doc := range docs {
+		createdAt, ok := doc["createdAt"].(primitive.DateTime)
+		if !ok {
+			continue
+		}
+		at, id := createdAt.Time(), idToHex(doc["_id"])
+		if !newest.covers(at, id) {
+			newest = watermark{Id: id, At: &at}
+		}
+	}
+	if newest.At == nil {
+		return primitive.ObjectID{}, time.Time{}, false
+	}
+	id, err := primitive.ObjectIDFromHex(newest.Id)
+	return id, *newest.At, err == nil
+}
+
+// unreadCounts is the number of posts per followed login and of messages per
+// room the user hasn't seen.
+type unreadCounts struct {
+	Posts    map[string]int `json:"posts"`
+	Messages map[int]int    `json:"messages"`
+}
+
+// GetUnread returns the unread posts and messages of the user.
+func GetUnread(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+
+	res, err := getUnread(id)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, res)
+}
+
+func GetMissedPosts(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+
+	res, err := getUnread(id)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, res.Posts)
+}
+
+func GetMissedMsg(c *gin.Context) {
+	id := auth.GetPrincipal(c).Id
+
+	res, err := getUnread(id)
+	if err != nil {
+		log.Println(err)
+		c.String(500, "internal error")
+		return
+	}
+
+	c.JSON(200, res.Messages)
+}
+
+// getUnread loads the watermarks of the user in one Postgres query and counts
+// what lies past them in one aggregation over posts and messages. Own messages
+// are never unread.
+func getUnread(userId int) (unreadCounts, error) {
+	res := unreadCounts{
+		Posts:    make(map[string]int),
+		Messages: make(map[int]int),
+	}
+
+	conn := database.PostgreConn
+	rows, err := conn.Query(context.Background(), `select 'post', followers.user_id, users.login, followers.last_seen_post, followers.last_seen_post_at
+		from followers join users on users.id=followers.user_id where followers.follower_id=$1
+		union all
+		select 'msg', room_id, '', last_read, last_read_at from read_msg where user_id=$1`, userId)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	logins := make(map[int]string)
+	postFilters, msgFilters := bson.A{}, bson.A{}
+	for rows.Next() {
+		var kind, login string
+		var id int
+		var seen watermark
+		var seenId *string
+		if err := rows.Scan(&kind, &id, &login, &seenId, &seen.At); err != nil {
+			return res, err
+		}
+		if seenId != nil {
+			seen.Id = *seenId
+		}
+		if kind == "post" {
+			logins[id] = login
+			res.Posts[login] = 0
+			postFilters = append(postFilters, seen.after("userId", id))
+		} else {
+			res.Messages[id] = 0
+			msgFilters = append(msgFilters, seen.after("roomId", id))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+	if len(postFilters) == 0 && len(msgFilters) == 0 {
+		return res, nil
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": anyOf(postFilters)},
+		bson.M{"$group": bson.M{"_id": bson.M{"kind": "post", "id": "$userId"}, "count": bson.M{"$sum": 1}}},
+		bson.M{"$unionWith": bson.M{
+			"coll": "messages",
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$and": bson.A{anyOf(msgFilters), bson.M{"userId": bson.M{"$ne": userId}, "deleted": bson.M{"$ne": true}}}}},
+				bson.M{"$group": bson.M{"_id": bson.M{"kind": "msg", "id": "$roomId"}, "count": bson.M{"$sum": 1}}},
+			},
+		}},
+	}
+	cursor, err := database.MI.DB.Collection("posts").Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return res, err
+	}
+	var counts []struct {
+		Id struct {
+			Kind string `bson:"kind"`
+			Id   int    `bson:"id"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	if err := cursor.All(context.Background(), &counts); err != nil {
+		return res, err
+	}
+
+	for _, count := range counts {
+		if count.Id.Kind == "post" {
+			res.Posts[logins[count.Id.Id]] = count.Count
+		} else {
+			res.Messages[count.Id.Id] = count.Count
+		}
+	}
+	return res, nil
+}
+
+// anyOf matches the documents matching one of the filters, or none when
+// there are no filters.
+func anyOf(filters bson.A) bson.M {
+	if len(filters) == 0 {
+		return bson.M{"_id": bson.M{"$in": bson.A{}}}
+	}
+	return bson.M{"$or": filters}
+}
+
+// markPostsSeen moves the watermark of a follower on the posts of an author
+// forward to a post. It never moves back.
+func markPostsSeen(followerId, authorId int, postId primitive.ObjectID, createdAt time.Time) error {
+	conn := database.PostgreConn
+	_, err := conn.Exec(context.Background(), `update followers set last_seen_post=$1, last_seen_post_at=$2
+		where user_id=$3 and follower_id=$4 and (last_seen_post_at is null or (last_seen_post_at, last_seen_post) < ($2, $1))`,
+		postId.Hex(), createdAt, authorId, followerId)
+	return err
+}
@@ -9,6 +9,7 @@ import (
 	"social-media/models"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func RegisterUser(c *gin.Context) {
@@ -36,7 +37,7 @@ func RegisterUser(c *gin.Context) {
 		return
 	}
 
-	token, err := auth.GenerateJWT(id, login)
+	pair, err := auth.NewSession(id, login)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
@@ -49,9 +50,8 @@ func RegisterUser(c *gin.Context) {
 	}
 	models.ActiveUsers.Set(id, user)
 
-	c.JSON(200, gin.H{
-		"token": token,
-	})
+	auth.SetSessionCookies(c, pair)
+	c.JSON(200, pair)
 }
 
 func UserLogin(c *gin.Context) {
@@ -74,7 +74,7 @@ func UserLogin(c *gin.Context) {
 		return
 	}
 
-	token, err := auth.GenerateJWT(id, login)
+	pair, err := auth.NewSession(id, login)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
@@ -87,25 +87,13 @@ func UserLogin(c *gin.Context) {
 	}
 	models.ActiveUsers.Set(id, user)
 
-	c.JSON(200, gin.H{
-		"token": token,
-	})
+	auth.SetSessionCookies(c, pair)
+	c.JSON(200, pair)
 }
 
 func FollowUser(c *gin.Context) {
 	userLogin := c.Param("login")
-	token, err := c.Cookie("token")
-	if err != nil {
-		log.Println(err)
-		c.String(400, "no token")
-		return
-	}
-	id, _, err := auth.TokenCredentials(token)
-	if err != nil {
-		log.Println(err)
-		c.String(400, "invalid credentials")
-		return
-	}
+	id := auth.GetPrincipal(c).Id
 
 	followerId, err := getIdByLogin(userLogin)
 	if err != nil {
@@ -123,6 +111,56 @@ func FollowUser(c *gin.Context) {
 
 }
 
+type author struct {
+	Login      string `json:"login"`
+	FirstName  string `json:"firstName"`
+	SecondName string `json:"secondName"`
+}
+
+// getAuthors loads the profiles of several users in one query.
+func getAuthors(ids []int) (map[int]author, error) {
+	res := make(map[int]author)
+	if len(ids) == 0 {
+		return res, nil
+	}
+	conn := database.PostgreConn
+	rows, err := conn.Query(context.Background(), "select id, login, first_name, second_name from users where id = any($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var a author
+		if err := rows.Scan(&id, &a.Login, &a.FirstName, &a.SecondName); err != nil {
+			return nil, err
+		}
+		res[id] = a
+	}
+	return res, rows.Err()
+}
+
+// setAuthors adds the login and profile of the author to each document,
+// reading the author id from key.
+func setAuthors(docs []bson.M, key string) error {
+	var ids []int
+	for _, doc := range docs {
+		ids = append(ids, intValue(doc[key]))
+	}
+	authors, err := getAuthors(ids)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if a, ok := authors[intValue(doc[key])]; ok {
+			doc["login"] = a.Login
+			doc["author"] = a
+		}
+	}
+	return nil
+}
+
 func getIdByLogin(login string) (int, error) {
 	var id int
 	conn := database.PostgreConn
@@ -156,20 +194,9 @@ func GetFollowedInfo(c *gin.Context) {
 }
 
 func FollowingAccounts(c *gin.Context) {
-	token, err := c.Cookie("token")
-	if err != nil {
-		log.Println(err)
-		c.String(400, "no token")
-		return
-	}
-	id, _, err := auth.TokenCredentials(token)
-	if err != nil {
-		log.Println(err)
-		c.String(400, "invalid credentials")
-		return
-	}
+	id := auth.GetPrincipal(c).Id
 
-	following, err := getFollowingLogins(id)
+	following, err := followeeLoginsOf(id)
 	if err != nil {
 		log.Println(err)
 		c.String(500, "internal error")
@@ -179,14 +206,15 @@ func FollowingAccounts(c *gin.Context) {
 	c.JSON(200, following)
 }
 
-func getFollowingIds(id int) ([]int, error) {
+// followersOf returns the ids of the accounts following the user.
+func followersOf(id int) ([]int, error) {
 	conn := database.PostgreConn
 	rows, err := conn.Query(context.Background(), "select follower_id from followers where user_id=$1", id)
 	if err != nil {
 		return nil, err
 	}
 
-	var following []int
+	var followers []int
 	for rows.Next() {
 		var user int
 		err = rows.Scan(&user)
@@ -194,12 +222,34 @@ func getFollowingIds(id int) ([]int, error) {
 			log.Println(err)
 			continue
 		}
-		following = append(following, user)
+		followers = append(followers, user)
 	}
-	return following, nil
+	return followers, nil
+}
+
+// followeesOf returns the ids of the accounts the user follows.
+func followeesOf(id int) ([]int, error) {
+	conn := database.PostgreConn
+	rows, err := conn.Query(context.Background(), "select user_id from followers where follower_id=$1", id)
+	if err != nil {
+		return nil, err
+	}
+
+	var followees []int
+	for rows.Next() {
+		var user int
+		err = rows.Scan(&user)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		followees = append(followees, user)
+	}
+	return followees, nil
 }
 
-func getFollowingLogins(id int) ([]string, error) {
+// followeeLoginsOf returns the logins of the accounts the user follows.
+func followeeLoginsOf(id int) ([]string, error) {
 	conn := database.PostgreConn
 	rows, err := conn.Query(context.Background(), "select login from users join followers on users.id = followers.user_id and followers.follower_id=$1", id)
 	if err != nil {
@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"social-media/auth"
+	"social-media/ws"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RegisterWSCommands installs the handlers of the commands clients send over
+// the WebSocket envelope protocol. Commands that change state need
+// ScopeWrite, like every HTTP request that isn't a read.
+func RegisterWSCommands() {
+	ws.Handle("message.send", wsRequireWrite(wsSendMessage))
+	ws.Handle("ack", wsRequireWrite(wsAck))
+	ws.Handle("read", wsRequireWrite(wsRead))
+	ws.Handle("typing", wsRequireWrite(wsTyping))
+	ws.Handle("presence", wsRequireWrite(wsPresence))
+	ws.Handle("subscribe", wsSubscribe)
+	ws.Handle("unsubscribe", wsUnsubscribe)
+}
+
+// wsRequireWrite rejects the command unless the connection was opened with
+// credentials holding ScopeWrite.
+func wsRequireWrite(handler ws.CommandHandler) ws.CommandHandler {
+	return func(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+		if !client.HasScope(auth.ScopeWrite) {
+			return nil, ws.NewError(ws.ErrForbidden, "insufficient scope")
+		}
+		return handler(client, raw)
+	}
+}
+
+type roomPayload struct {
+	RoomId int `json:"roomId"`
+}
+
+type sendMessagePayload struct {
+	RoomId  int    `json:"roomId"`
+	Text    string `json:"text"`
+	ReplyTo string `json:"replyTo"`
+}
+
+type ackPayload struct {
+	RoomId    int    `json:"roomId"`
+	MessageId string `json:"messageId"`
+}
+
+// wsSendMessage stores a message like POST /message does and acknowledges it
+// with the id it was persisted under.
+func wsSendMessage(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+	var payload sendMessagePayload
+	if err := json.Unmarshal(raw, &payload); err != nil || payload.RoomId == 0 || payload.Text == "" {
+		return nil, ws.NewError(ws.ErrBadRequest, "roomId and text are required")
+	}
+	if err := checkPost(payload.RoomId, client.UserId); err != nil {
+		return nil, wsRoomError(err)
+	}
+
+	parent, err := replyParent(payload.RoomId, payload.ReplyTo)
+	if errors.Is(err, errNoMessage) {
+		return nil, ws.NewError(ws.ErrBadRequest, "replyTo isn't a message of the room")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := saveMessage(client.UserId, client.Login, payload.RoomId, payload.Text, nil, nil, parent)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"messageId": msg["_id"],
+		"roomId":    payload.RoomId,
+		"createdAt": msg["createdAt"],
+	}, nil
+}
+
+// wsAck is sent by clients when they received a pushed message. It moves the
+// delivered pointer of the user in the room.
+func wsAck(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+	return wsMark(client, raw, receiptDelivered)
+}
+
+// wsRead is sent by clients when the user has seen the messages of a room up
+// to the given one.
+func wsRead(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+	return wsMark(client, raw, receiptRead)
+}
+
+func wsMark(client *ws.Client, raw json.RawMessage, status string) (interface{}, error) {
+	var payload ackPayload
+	if err := json.Unmarshal(raw, &payload); err != nil || payload.RoomId == 0 {
+		return nil, ws.NewError(ws.ErrBadRequest, "roomId and messageId are required")
+	}
+	msgId, err := primitive.ObjectIDFromHex(payload.MessageId)
+	if err != nil {
+		return nil, ws.NewError(ws.ErrBadRequest, "roomId and messageId are required")
+	}
+
+	err = markMessages(client.UserId, client.Login, payload.RoomId, msgId, status)
+	if errors.Is(err, errNotMember) {
+		return nil, ws.NewError(ws.ErrForbidden, "not a member of the room")
+	}
+	if errors.Is(err, errNoMessage) {
+		return nil, ws.NewError(ws.ErrNotFound, "message not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func wsSubscribe(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+	var payload roomPayload
+	if err := json.Unmarshal(raw, &payload); err != nil || payload.RoomId == 0 {
+		return nil, ws.NewError(ws.ErrBadRequest, "roomId is required")
+	}
+	if _, _, err := checkMember(payload.RoomId, client.UserId, roomActionWatch); err != nil {
+		return nil, wsRoomError(err)
+	}
+	client.Subscribe(payload.RoomId)
+	return payload, nil
+}
+
+func wsUnsubscribe(client *ws.Client, raw json.RawMessage) (interface{}, error) {
+	var payload roomPayload
+	if err := json.Unmarshal(raw, &payload); err != nil || payload.RoomId == 0 {
+		return nil, ws.NewError(ws.ErrBadRequest, "roomId is required")
+	}
+	client.Unsubscribe(payload.RoomId)
+	return payload, nil
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -14,24 +14,15 @@ import (
 )
 
 func UpgradeToWS(c *gin.Context) {
-	token, err := c.Cookie("token")
-	if err != nil {
-		log.Println(err)
-		c.String(400, "no token")
-		return
-	}
-	id, login, err := auth.TokenCredentials(token)
-	if err != nil {
-		log.Println(err)
-		c.String(400, "invalid credentials")
-		return
-	}
+	principal := auth.GetPrincipal(c)
+	id, login := principal.Id, principal.Login
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
+		Subprotocols: []string{ws.Subprotocol},
 	}
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -40,17 +31,28 @@ func UpgradeToWS(c *gin.Context) {
 		c.String(500, "internal error")
 		return
 	}
-	defer conn.Close()
-	if user, ok := models.ActiveUsers.Get(id); ok {
-		user.Conn = conn
-	} else {
-		newUsers := &models.User{
-			Id:    id,
-			Login: login,
-			Conn:  conn,
-		}
-		models.ActiveUsers.Set(id, newUsers)
+	client := ws.NewClient(conn, id, login)
+	client.Scopes = principal.Scopes
+	client.APIKeyId = principal.APIKeyId
+	if principal.Claims != nil {
+		client.Session = principal.Claims.Session
+	}
+	// Later connections keep the presence the user reported, e.g. away.
+	if ws.Hub.Register(client) {
+		models.ActiveUsers.Set(id, &models.User{
+			Id:       id,
+			Login:    login,
+			Presence: models.PresenceOnline,
+		})
+		userOnline(id, login)
 	}
+	defer func() {
+		if ws.Hub.Unregister(client) {
+			userOffline(id, login)
+			evictUser(id)
+		}
+	}()
+	go client.WritePump()
 
 	var ids []int
 	psql := database.PostgreConn
@@ -72,21 +74,28 @@ func UpgradeToWS(c *gin.Context) {
 
 	for _, id := range ids {
 		if _, ok := models.ActiveRoom.Get(id); !ok {
-			var name string
-			var users []int
-			err = psql.QueryRow(context.Background(), "select name, array_agg(user_id) from rooms join urooms on rooms.id=urooms.room_id and rooms.id=$1 group by rooms.id, urooms.name", id).Scan(&name, &users)
+			room, err := loadRoom(id)
 			if err != nil {
 				log.Println(err)
 				continue
 			}
-			room := &models.Room{
-				Id:    id,
-				Name:  name,
-				Users: users,
-			}
-			models.ActiveRoom.Set(id, room)
+			models.ActiveRoom.Update(room)
 		}
 	}
 
-	ws.WSHandler(conn)
+	ws.WSHandler(client)
+}
+
+// evictUser drops a user whose last connection closed from the in-memory
+// caches, together with the rooms that have no connected member left.
+func evictUser(id int) {
+	models.ActiveUsers.Delete(id)
+	models.ActiveRoom.DeleteIf(func(room *models.Room) bool {
+		for _, user := range room.Users {
+			if ws.Hub.Online(user) {
+				return false
+			}
+		}
+		return true
+	})
 }
@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -36,5 +37,55 @@ func InitMongoDatabase(mongoURI, name string) error {
 		Client: client,
 		DB:     db,
 	}
+	if err := backfillTimestamps(db); err != nil {
+		return err
+	}
+	return createIndexes(db)
+}
+
+// indexes lists the indexes each collection needs. CreateMany is a no-op for
+// indexes that already exist, so they are created on every start.
+var indexes = map[string][]mongo.IndexModel{
+	"posts": {
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+	},
+	"comments": {
+		{Keys: bson.D{{Key: "postId", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "rootId", Value: 1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}},
+	},
+	"messages": {
+		{Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "threadId", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+	},
+}
+
+// timestamped lists the collections whose documents carry createdAt and
+// updatedAt. Documents stored before those fields existed get the time
+// encoded in their ObjectID.
+var timestamped = []string{"posts", "comments", "messages"}
+
+func backfillTimestamps(db *mongo.Database) error {
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"createdAt": bson.M{"$toDate": "$_id"},
+			"updatedAt": bson.M{"$toDate": "$_id"},
+		}}},
+	}
+	for _, collection := range timestamped {
+		_, err := db.Collection(collection).UpdateMany(context.Background(), bson.M{"createdAt": bson.M{"$exists": false}}, update)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createIndexes(db *mongo.Database) error {
+	for collection, models := range indexes {
+		if _, err := db.Collection(collection).Indexes().CreateMany(context.Background(), models); err != nil {
+			return err
+		}
+	}
 	return nil
 }
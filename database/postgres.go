@@ -15,5 +15,9 @@ func InitPostgreSQL(url string) {
 		log.Println(err)
 		panic("Unable to connect to database")
 	}
+	if err := migratePostgreSQL(pool); err != nil {
+		log.Println(err)
+		panic("Unable to migrate database")
+	}
 	PostgreConn = pool
 }
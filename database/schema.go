@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// schema holds the statements that create tables added after the initial
+// users, followers, rooms, urooms and read_msg tables. They are run on
+// every start, so each of them must be safe to repeat.
+var schema = []string{
+	`create table if not exists refresh_tokens (
+		id serial primary key,
+		user_id int not null,
+		family_id text not null,
+		token_hash text not null unique,
+		created_at timestamptz not null default now(),
+		expires_at timestamptz not null,
+		family_expires_at timestamptz not null,
+		used_at timestamptz,
+		revoked_at timestamptz
+	)`,
+	`create index if not exists refresh_tokens_family_idx on refresh_tokens (family_id)`,
+	`create table if not exists revoked_tokens (
+		jti text primary key,
+		user_id int not null,
+		expires_at timestamptz not null
+	)`,
+	`create table if not exists revoked_users (
+		user_id int primary key,
+		revoked_before timestamptz not null,
+		expires_at timestamptz not null
+	)`,
+	`create table if not exists revoked_sessions (
+		session text primary key,
+		expires_at timestamptz not null
+	)`,
+	`create table if not exists api_keys (
+		id serial primary key,
+		user_id int not null,
+		name text not null,
+		key_hash text not null unique,
+		prefix text not null,
+		scopes text[] not null default '{}',
+		created_at timestamptz not null default now(),
+		expires_at timestamptz,
+		last_used_at timestamptz,
+		revoked_at timestamptz
+	)`,
+	`create index if not exists api_keys_user_idx on api_keys (user_id)`,
+	`alter table users add column if not exists role text not null default 'user'`,
+	`create table if not exists user_scopes (
+		user_id int not null,
+		scope text not null,
+		primary key (user_id, scope)
+	)`,
+	`alter table users add column if not exists last_seen timestamptz`,
+	// Members had read the rooms up to a counter before, which can't be
+	// mapped to messages. When the pointers are added, everything sent
+	// until then counts as delivered and read, instead of the whole
+	// history turning unread.
+	`do $$ begin
+		if not exists (select 1 from information_schema.columns where table_name='read_msg' and column_name='last_read_at') then
+			alter table read_msg add column last_delivered text;
+			alter table read_msg add column last_delivered_at timestamptz;
+			alter table read_msg add column last_read text;
+			alter table read_msg add column last_read_at timestamptz;
+			update read_msg set last_delivered='', last_delivered_at=now(), last_read='', last_read_at=now();
+		end if;
+	end $$`,
+	// Like the room pointers above, the posts published before the
+	// watermarks existed count as seen by the followers of the time.
+	`do $$ begin
+		if not exists (select 1 from information_schema.columns where table_name='followers' and column_name='last_seen_post_at') then
+			alter table followers add column last_seen_post text;
+			alter table followers add column last_seen_post_at timestamptz;
+			update followers set last_seen_post='', last_seen_post_at=now();
+		end if;
+	end $$`,
+	`alter table rooms add column if not exists owner_id int`,
+	`alter table rooms add column if not exists read_only boolean not null default false`,
+	`alter table urooms add column if not exists role text not null default 'member'`,
+	`alter table rooms add column if not exists kind text not null default 'group'`,
+	// Group rooms created before owners were recorded don't know their
+	// creator anymore, so they go to the member with the oldest account.
+	`update rooms set owner_id=(select min(user_id) from urooms where room_id=rooms.id)
+		where owner_id is null and kind='group'`,
+	`update urooms set role='owner' from rooms
+		where rooms.id=urooms.room_id and rooms.owner_id=urooms.user_id and urooms.role<>'owner'`,
+	`alter table rooms add column if not exists dm_key text`,
+	`create unique index if not exists rooms_dm_key_idx on rooms (dm_key)`,
+	`create table if not exists read_thread (
+		user_id int not null,
+		room_id int not null,
+		thread_id text not null,
+		last_read text not null,
+		last_read_at timestamptz not null,
+		primary key (user_id, thread_id)
+	)`,
+	`create table if not exists audit_log (
+		id bigserial primary key,
+		user_id int not null,
+		action text not null,
+		target text not null,
+		detail text not null default '',
+		created_at timestamptz not null default now()
+	)`,
+	`create index if not exists audit_log_user_idx on audit_log (user_id, created_at)`,
+}
+
+func migratePostgreSQL(pool *pgxpool.Pool) error {
+	for _, stmt := range schema {
+		if _, err := pool.Exec(context.Background(), stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package hash
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 
 	"golang.org/x/crypto/argon2"
 )
@@ -32,3 +34,19 @@ func CheckPassword(password, encodedHash string) bool {
 
 	return bytes.Equal(hash, testHash)
 }
+
+// HashToken returns a deterministic digest of a high-entropy random token so
+// it can be stored and looked up without keeping the token itself.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RandomToken returns a url-safe random string built from n random bytes.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
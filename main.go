@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"path"
 	"path/filepath"
+	"social-media/auth"
 	"social-media/controller"
 	"social-media/database"
 	"social-media/middleware"
+	"social-media/ws"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gopkg.in/ini.v1"
@@ -26,6 +31,11 @@ type Config struct {
 	mongoHost     string
 	mongoPort     string
 	mongoDbName   string
+
+	jwtSigningKey string
+	jwtKeys       []auth.KeyConfig
+
+	ws ws.Config
 }
 
 func main() {
@@ -35,12 +45,26 @@ func main() {
 		return
 	}
 	postgresURI := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", config.postgresUser, config.postgresPassword, config.postgresHost, config.postgresPort, config.postgresDbName)
+	if err := auth.InitKeys(config.jwtKeys, config.jwtSigningKey); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := ws.Configure(config.ws); err != nil {
+		log.Println(err)
+		return
+	}
 	database.InitPostgreSQL(postgresURI)
 	defer database.PostgreConn.Close()
+	auth.StartRevocationSync(30 * time.Second)
 	mongoURI := fmt.Sprintf("mongodb://%s:%s@%s:%s", config.mongoUser, config.mongoPassword, config.mongoHost, config.mongoPort)
-	database.InitMongoDatabase(mongoURI, config.mongoDbName)
+	if err := database.InitMongoDatabase(mongoURI, config.mongoDbName); err != nil {
+		log.Println(err)
+		return
+	}
 	defer database.MI.Client.Disconnect(context.Background())
 
+	controller.RegisterWSCommands()
+
 	routes := gin.Default()
 
 	routes.NoRoute(func(c *gin.Context) {
@@ -55,8 +79,17 @@ func main() {
 
 	routes.POST("/register", controller.RegisterUser)
 	routes.POST("/login", controller.UserLogin)
+	routes.POST("/token/refresh", controller.RefreshToken)
+	routes.GET("/.well-known/jwks.json", controller.GetJWKS)
 
 	authorized := routes.Group("/", middleware.Auth)
+	authorized.POST("/logout", controller.Logout)
+	authorized.POST("/logout/all", controller.LogoutAll)
+
+	authorized.POST("/apikeys", controller.CreateAPIKey)
+	authorized.GET("/apikeys", controller.GetAPIKeys)
+	authorized.DELETE("/apikeys/:id", controller.RevokeAPIKey)
+
 	authorized.GET("/ws", controller.UpgradeToWS)
 	authorized.Static("/upload", "./upload/")
 
@@ -66,6 +99,7 @@ func main() {
 
 	authorized.GET("/missed", controller.GetMissedPosts)
 	authorized.GET("/missed-msg", controller.GetMissedMsg)
+	authorized.GET("/unread", controller.GetUnread)
 
 	authorized.POST("/follow/:login", controller.FollowUser)
 	authorized.GET("/follow/:login", controller.GetFollowedInfo)
@@ -74,17 +108,48 @@ func main() {
 	authorized.PUT("/post", controller.ChangeMessage)
 	authorized.GET("/post", controller.GetNPosts)
 	authorized.GET("/post/:login", controller.GetOtherPosts)
+	authorized.GET("/feed", controller.GetFeed)
+	authorized.DELETE("/post/:id", controller.DeletePost)
+	authorized.GET("/post-history/:id", controller.GetPostHistory)
 
 	authorized.GET("/follow", controller.FollowingAccounts)
 
 	authorized.POST("/comment", controller.PostComment)
 	authorized.GET("/comment/:postId", controller.GetComments)
+	authorized.DELETE("/comment/:id", controller.DeleteComment)
 
 	authorized.POST("/room", controller.NewRoom)
 	authorized.GET("/rooms", controller.GetRooms)
+	authorized.POST("/dm", controller.NewDirectRoom)
+	authorized.GET("/dm/:login", controller.GetDirectRoom)
+	authorized.POST("/room/:id/members", controller.InviteMembers)
+	authorized.DELETE("/room/:id/members/:login", controller.RemoveMember)
+	authorized.PUT("/room/:id/members/:login/role", controller.SetMemberRole)
+	authorized.PUT("/room/:id/settings", controller.UpdateRoomSettings)
+	authorized.POST("/room/:id/leave", controller.LeaveRoom)
+	authorized.PUT("/room/:id/name", controller.RenameRoom)
+	authorized.PUT("/room/:id/owner", controller.TransferRoom)
+	authorized.DELETE("/room/:id", controller.DeleteRoom)
 
 	authorized.POST("/message", controller.ReceiveMessage)
 	authorized.GET("/msg/:id", controller.GetMessages)
+	authorized.POST("/msg/:id/read", controller.ReadMessages)
+	authorized.PUT("/msg/:id/:msgId", controller.EditMessage)
+	authorized.DELETE("/msg/:id/:msgId", controller.DeleteMessage)
+	authorized.POST("/msg/:id/:msgId/reactions", controller.AddReaction)
+	authorized.DELETE("/msg/:id/:msgId/reactions/:emoji", controller.RemoveReaction)
+	authorized.GET("/msg/:id/receipts", controller.GetReceipts)
+	authorized.GET("/msg/:id/thread/:msgId", controller.GetThread)
+	authorized.GET("/typing/:id", controller.GetTyping)
+
+	authorized.GET("/presence", controller.GetPresence)
+
+	admin := authorized.Group("/admin", middleware.RequireScope(auth.ScopeManageUsers))
+	admin.GET("/users/:login/grants", controller.GetUserGrants)
+	admin.PUT("/users/:login/role", controller.ChangeUserRole)
+	admin.POST("/users/:login/scopes", controller.GrantUserScope)
+	admin.DELETE("/users/:login/scopes/:scope", controller.RevokeUserScope)
+	admin.GET("/metrics", gin.WrapH(expvar.Handler()))
 
 	routes.Run(":8080")
 }
@@ -109,5 +174,23 @@ func getConfig(path string) (Config, error) {
 	config.mongoPort = mSect.Key("mongo_port").String()
 	config.mongoDbName = mSect.Key("mongo_db_name").String()
 
+	jSect := cfg.Section("jwt")
+	config.jwtSigningKey = jSect.Key("signing_key").String()
+	for _, kSect := range jSect.ChildSections() {
+		config.jwtKeys = append(config.jwtKeys, auth.KeyConfig{
+			Id:             strings.TrimPrefix(kSect.Name(), "jwt."),
+			Algorithm:      kSect.Key("algorithm").MustString("HS256"),
+			Secret:         kSect.Key("secret").String(),
+			SecretFile:     kSect.Key("secret_file").String(),
+			PrivateKeyFile: kSect.Key("private_key_file").String(),
+			PublicKeyFile:  kSect.Key("public_key_file").String(),
+		})
+	}
+
+	wSect := cfg.Section("ws")
+	config.ws.PingInterval = wSect.Key("ping_interval").MustDuration(0)
+	config.ws.PongWait = wSect.Key("pong_wait").MustDuration(0)
+	config.ws.WriteWait = wSect.Key("write_wait").MustDuration(0)
+
 	return config, nil
 }
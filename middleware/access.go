@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"social-media/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireScope only lets callers through that hold every given scope. It must
+// run after Auth.
+func RequireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.GetPrincipal(c)
+		for _, scope := range scopes {
+			if !principal.HasScope(scope) {
+				c.String(403, "insufficient scope")
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
@@ -1,26 +1,138 @@
 package middleware
 
 import (
+	"errors"
 	"log"
+	"net/http"
 	"social-media/auth"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+var (
+	errNoCredentials = errors.New("no credentials")
+	errAuthHeader    = errors.New("malformed authorization header")
+)
+
+// Auth authenticates the request once and stores the caller in the context,
+// where handlers read it with auth.GetPrincipal. Credentials are taken from
+// an Authorization: Bearer header (access token or API key), an X-API-Key
+// header, or the token cookie used by the browser client.
 func Auth(c *gin.Context) {
-	token, err := c.Cookie("token")
+	principal, err := authenticate(c)
 	if err != nil {
 		log.Println(err)
-		c.String(403, "no credentials")
+		switch {
+		case errors.Is(err, errNoCredentials):
+			c.String(403, "no credentials")
+		case errors.Is(err, auth.ErrTokenExpired):
+			c.String(401, "token expired")
+		case errors.Is(err, auth.ErrTokenRevoked):
+			c.String(401, "token revoked")
+		default:
+			c.String(403, "invalid credentials")
+		}
 		c.Abort()
 		return
 	}
 
-	if err := auth.ValidateToken(token); err != nil {
-		log.Println(err)
-		c.String(403, "invalid credentials")
+	if !principal.HasScope(methodScope(c.Request.Method)) {
+		c.String(403, "insufficient scope")
 		c.Abort()
 		return
 	}
+
+	auth.SetPrincipal(c, principal)
 	c.Next()
 }
+
+func authenticate(c *gin.Context) (*auth.Principal, error) {
+	if header := c.GetHeader("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, errAuthHeader
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if strings.HasPrefix(token, auth.APIKeyPrefix) {
+			return auth.APIKeyPrincipal(token)
+		}
+		claims, err := auth.ValidClaims(token)
+		if err != nil {
+			return nil, err
+		}
+		return claimsPrincipal(claims), nil
+	}
+
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return auth.APIKeyPrincipal(key)
+	}
+
+	claims, err := cookieClaims(c)
+	if err != nil {
+		return nil, err
+	}
+	return claimsPrincipal(claims), nil
+}
+
+func claimsPrincipal(claims *auth.JWTClaim) *auth.Principal {
+	return &auth.Principal{
+		Id:     claims.ID,
+		Login:  claims.Login,
+		Role:   claims.Role,
+		Scopes: claims.Scopes,
+		Claims: claims,
+	}
+}
+
+// methodScope is the scope every request needs: reads only need ScopeRead,
+// everything else changes state and needs ScopeWrite.
+func methodScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return auth.ScopeRead
+	}
+	return auth.ScopeWrite
+}
+
+func cookieClaims(c *gin.Context) (*auth.JWTClaim, error) {
+	token, err := c.Cookie(auth.AccessCookie)
+	if err != nil {
+		if claims, ok := refreshSession(c); ok {
+			return claims, nil
+		}
+		return nil, errNoCredentials
+	}
+
+	claims, err := auth.ValidClaims(token)
+	if err != nil {
+		if claims, ok := refreshSession(c); ok {
+			return claims, nil
+		}
+		return nil, err
+	}
+	return claims, nil
+}
+
+// refreshSession keeps browser sessions sliding: when the access token is
+// missing or expired but the refresh cookie is still valid, a new pair is
+// issued and the request proceeds with the new access token.
+func refreshSession(c *gin.Context) (*auth.JWTClaim, bool) {
+	refreshToken, err := c.Cookie(auth.RefreshCookie)
+	if err != nil {
+		return nil, false
+	}
+	pair, err := auth.RefreshSession(refreshToken)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	// The old refresh token is spent now, so the new pair has to reach the
+	// client even if this request fails.
+	auth.SetSessionCookies(c, pair)
+	claims, err := auth.ValidClaims(pair.AccessToken)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	return claims, true
+}
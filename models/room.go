@@ -2,6 +2,7 @@ package models
 
 import (
 	"sync"
+	"time"
 )
 
 var ActiveRoom = roomMap{
@@ -13,21 +14,166 @@ type roomMap struct {
 	data map[int]*Room
 }
 
-func (rooms roomMap) Get(key int) (*Room, bool) {
+func (rooms *roomMap) Get(key int) (*Room, bool) {
 	rooms.mux.RLock()
 	defer rooms.mux.RUnlock()
 	room, ok := rooms.data[key]
 	return room, ok
 }
 
-func (rooms roomMap) Set(key int, value *Room) {
+func (rooms *roomMap) Set(key int, value *Room) {
 	rooms.mux.Lock()
 	defer rooms.mux.Unlock()
 	rooms.data[key] = value
 }
 
+func (rooms *roomMap) Delete(key int) {
+	rooms.mux.Lock()
+	defer rooms.mux.Unlock()
+	delete(rooms.data, key)
+}
+
+// DeleteIf removes the rooms for which evict returns true.
+func (rooms *roomMap) DeleteIf(evict func(*Room) bool) {
+	rooms.mux.Lock()
+	defer rooms.mux.Unlock()
+	for key, room := range rooms.data {
+		if evict(room) {
+			delete(rooms.data, key)
+		}
+	}
+}
+
+// Update stores the settings, owner and members of a room, keeping its
+// typing state for the users that are still members.
+func (rooms *roomMap) Update(value Room) {
+	rooms.mux.Lock()
+	defer rooms.mux.Unlock()
+	room, ok := rooms.data[value.Id]
+	if !ok {
+		room = &Room{Id: value.Id}
+		rooms.data[value.Id] = room
+	}
+	room.Name = value.Name
+	room.OwnerId = value.OwnerId
+	room.ReadOnly = value.ReadOnly
+	room.Direct = value.Direct
+	room.Users = value.Users
+	room.Roles = make(map[int]string, len(value.Roles))
+	for userId, role := range value.Roles {
+		room.Roles[userId] = role
+	}
+	for userId := range room.typing {
+		if _, member := room.Roles[userId]; !member {
+			delete(room.typing, userId)
+		}
+	}
+}
+
+// Member returns the role of a user in a cached room, empty when the user
+// isn't a member, and whether the room is read-only. cached is false when the
+// room isn't in the cache and the caller has to ask the database.
+func (rooms *roomMap) Member(key, userId int) (role string, readOnly bool, cached bool) {
+	rooms.mux.RLock()
+	defer rooms.mux.RUnlock()
+	room, ok := rooms.data[key]
+	if !ok {
+		return "", false, false
+	}
+	return room.Roles[userId], room.ReadOnly, true
+}
+
+// SetTyping marks a user as typing in a room until the given time, or clears
+// the mark when until is zero. It reports false when the room isn't cached.
+func (rooms *roomMap) SetTyping(key, userId int, until time.Time) bool {
+	rooms.mux.Lock()
+	defer rooms.mux.Unlock()
+	room, ok := rooms.data[key]
+	if !ok {
+		return false
+	}
+	if until.IsZero() {
+		delete(room.typing, userId)
+		return true
+	}
+	if room.typing == nil {
+		room.typing = make(map[int]time.Time)
+	}
+	room.typing[userId] = until
+	return true
+}
+
+// Typing returns the users currently typing in a room.
+func (rooms *roomMap) Typing(key int) []int {
+	rooms.mux.RLock()
+	defer rooms.mux.RUnlock()
+	room, ok := rooms.data[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	var users []int
+	for userId, until := range room.typing {
+		if until.After(now) {
+			users = append(users, userId)
+		}
+	}
+	return users
+}
+
+// ClearTyping removes the typing marks of a user from every room and returns
+// the rooms the user was typing in.
+func (rooms *roomMap) ClearTyping(userId int) []int {
+	rooms.mux.Lock()
+	defer rooms.mux.Unlock()
+	var cleared []int
+	for key, room := range rooms.data {
+		if _, ok := room.typing[userId]; ok {
+			delete(room.typing, userId)
+			cleared = append(cleared, key)
+		}
+	}
+	return cleared
+}
+
+// Roles of the members of a room. The owner has every right of an admin and
+// is the only one who can promote admins, transfer or delete the room.
+const (
+	RoomOwner  = "owner"
+	RoomAdmin  = "admin"
+	RoomMember = "member"
+)
+
+var roomRoleRanks = map[string]int{
+	RoomMember: 1,
+	RoomAdmin:  2,
+	RoomOwner:  3,
+}
+
+// ValidRoomRole reports whether role is one of the room roles.
+func ValidRoomRole(role string) bool {
+	_, ok := roomRoleRanks[role]
+	return ok
+}
+
+// RoomRoleAtLeast reports whether role grants at least the rights of min.
+// Unknown roles grant nothing.
+func RoomRoleAtLeast(role, min string) bool {
+	rank, ok := roomRoleRanks[role]
+	return ok && rank >= roomRoleRanks[min]
+}
+
+// Room is a chat room. In a read-only room only admins can post. A direct
+// room is the one-to-one conversation of two users; its members can't change.
 type Room struct {
-	Id    int    `json:"id"`
-	Name  string `json:"name"`
-	Users []int  `json:"users,omitempty"`
+	Id       int            `json:"id"`
+	Name     string         `json:"name"`
+	OwnerId  int            `json:"ownerId,omitempty"`
+	ReadOnly bool           `json:"readOnly"`
+	Direct   bool           `json:"direct,omitempty"`
+	Users    []int          `json:"users,omitempty"`
+	Roles    map[int]string `json:"roles,omitempty"`
+	// typing maps the users typing in the room to when the notice expires.
+	// It is guarded by ActiveRoom.
+	typing map[int]time.Time
 }
@@ -0,0 +1,45 @@
+package models
+
+import "testing"
+
+func TestRoomRoleAtLeast(t *testing.T) {
+	tests := []struct {
+		role string
+		min  string
+		want bool
+	}{
+		{RoomOwner, RoomOwner, true},
+		{RoomOwner, RoomAdmin, true},
+		{RoomOwner, RoomMember, true},
+		{RoomAdmin, RoomOwner, false},
+		{RoomAdmin, RoomAdmin, true},
+		{RoomAdmin, RoomMember, true},
+		{RoomMember, RoomAdmin, false},
+		{RoomMember, RoomMember, true},
+		{"", RoomMember, false},
+		{"guest", RoomMember, false},
+	}
+	for _, tt := range tests {
+		if got := RoomRoleAtLeast(tt.role, tt.min); got != tt.want {
+			t.Errorf("RoomRoleAtLeast(%q, %q) = %v, want %v", tt.role, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestValidRoomRole(t *testing.T) {
+	tests := []struct {
+		role  string
+		valid bool
+	}{
+		{RoomOwner, true},
+		{RoomAdmin, true},
+		{RoomMember, true},
+		{"", false},
+		{"moderator", false},
+	}
+	for _, tt := range tests {
+		if got := ValidRoomRole(tt.role); got != tt.valid {
+			t.Errorf("ValidRoomRole(%q) = %v, want %v", tt.role, got, tt.valid)
+		}
+	}
+}
@@ -2,8 +2,14 @@ package models
 
 import (
 	"sync"
+)
 
-	"github.com/gorilla/websocket"
+// Presence states of a user. A user without connections is offline; a
+// connected user is online unless a client reported the user as away.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
 )
 
 var ActiveUsers = userMap{
@@ -15,21 +21,53 @@ type userMap struct {
 	data map[int]*User
 }
 
-func (users userMap) Get(key int) (*User, bool) {
+func (users *userMap) Get(key int) (*User, bool) {
 	users.mux.RLock()
 	defer users.mux.RUnlock()
 	user, ok := users.data[key]
 	return user, ok
 }
 
-func (users userMap) Set(key int, user *User) {
+func (users *userMap) Set(key int, user *User) {
 	users.mux.Lock()
 	defer users.mux.Unlock()
 	users.data[key] = user
 }
 
+func (users *userMap) Delete(key int) {
+	users.mux.Lock()
+	defer users.mux.Unlock()
+	delete(users.data, key)
+}
+
+// SetPresence changes the presence of a cached user. It reports whether the
+// presence changed.
+func (users *userMap) SetPresence(key int, presence string) bool {
+	users.mux.Lock()
+	defer users.mux.Unlock()
+	user, ok := users.data[key]
+	if !ok || user.Presence == presence {
+		return false
+	}
+	user.Presence = presence
+	return true
+}
+
+// Presence returns the presence reported for a cached user.
+func (users *userMap) Presence(key int) (string, bool) {
+	users.mux.RLock()
+	defer users.mux.RUnlock()
+	user, ok := users.data[key]
+	if !ok {
+		return "", false
+	}
+	return user.Presence, true
+}
+
+// User is a user known to be logged in. Its connections are kept by ws.Hub.
+// Presence is guarded by ActiveUsers and must be changed through it.
 type User struct {
-	Id    int
-	Login string
-	Conn  *websocket.Conn
+	Id       int
+	Login    string
+	Presence string
 }
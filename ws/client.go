@@ -0,0 +1,210 @@
+package ws
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sendQueueSize is the number of frames buffered for a connection.
+	sendQueueSize = 64
+	// maxDroppedFrames is how many frames in a row may be dropped because
+	// the queue is full before the connection is closed. A client that far
+	// behind has to reconnect and reload anyway.
+	maxDroppedFrames = 16
+	// maxFrameSize limits inbound frames.
+	maxFrameSize = 64 * 1024
+)
+
+// Close codes sent to clients along with a reason.
+const (
+	CloseNormal     = websocket.CloseNormalClosure
+	CloseTooSlow    = websocket.CloseTryAgainLater
+	CloseFrameLimit = websocket.CloseMessageTooBig
+	// CloseLoggedOut is sent when the user's sessions were revoked.
+	CloseLoggedOut = 4001
+)
+
+// Client is one WebSocket connection of a user. A user has one client per
+// open tab or device. Frames are only written by the client's writer
+// goroutine; everyone else queues them with Send.
+type Client struct {
+	UserId int
+	Login  string
+	// Scopes are the scopes of the credentials the connection was opened
+	// with, checked by the handlers of commands that change state.
+	Scopes []string
+	// Session is the refresh token family of the access token the
+	// connection was opened with, empty for API keys.
+	Session string
+	// APIKeyId is the API key the connection was opened with, 0 for access
+	// tokens.
+	APIKeyId int
+	conn     *websocket.Conn
+	send     chan []byte
+	// version is the negotiated protocol version, 0 for the original one.
+	version int
+
+	subMux sync.RWMutex
+	rooms  map[int]struct{}
+
+	mux       sync.Mutex
+	dropped   int
+	closed    bool
+	closeOnce sync.Once
+	// closing is closed by Close once closeMsg holds the close frame the
+	// writer has to send.
+	closing  chan struct{}
+	closeMsg []byte
+}
+
+func NewClient(conn *websocket.Conn, userId int, login string) *Client {
+	client := &Client{
+		UserId:  userId,
+		Login:   login,
+		conn:    conn,
+		send:    make(chan []byte, sendQueueSize),
+		rooms:   make(map[int]struct{}),
+		closing: make(chan struct{}),
+	}
+	if conn.Subprotocol() == Subprotocol {
+		client.version = ProtocolVersion
+	}
+	return client
+}
+
+// HasScope reports whether the credentials of the connection grant scope.
+func (c *Client) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe makes the connection receive the ephemeral events of a room,
+// such as typing notices, which are only useful while the room is open.
+func (c *Client) Subscribe(roomId int) {
+	c.subMux.Lock()
+	defer c.subMux.Unlock()
+	c.rooms[roomId] = struct{}{}
+}
+
+func (c *Client) Unsubscribe(roomId int) {
+	c.subMux.Lock()
+	defer c.subMux.Unlock()
+	delete(c.rooms, roomId)
+}
+
+func (c *Client) Subscribed(roomId int) bool {
+	c.subMux.RLock()
+	defer c.subMux.RUnlock()
+	_, ok := c.rooms[roomId]
+	return ok
+}
+
+// Send queues a frame without blocking. When the queue is full the frame is
+// dropped, and a client that keeps falling behind is disconnected. It
+// reports whether the frame was queued; frames sent to a closing client are
+// not, and don't count as dropped.
+func (c *Client) Send(frame []byte) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case <-c.closing:
+		return false
+	default:
+	}
+	select {
+	case c.send <- frame:
+		c.dropped = 0
+		return true
+	default:
+	}
+
+	framesDropped.Add(1)
+	c.dropped++
+	log.Printf("ws: send queue of user %d is full, frame dropped", c.UserId)
+	if c.dropped >= maxDroppedFrames {
+		slowDisconnects.Add(1)
+		log.Printf("ws: disconnecting slow client of user %d", c.UserId)
+		c.Close(CloseTooSlow, "too slow")
+	}
+	return false
+}
+
+// closeSend stops the writer once the queued frames are written.
+func (c *Client) closeSend() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// Close makes the writer send a close frame with the given code and reason
+// and close the network connection, which makes the read loop fail and the
+// client get unregistered. It never blocks, so it may be called from any
+// goroutine, also while holding the hub lock.
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.closing)
+	})
+}
+
+// shutdown sends the requested close frame, or a normal one, and closes the
+// network connection. Only the writer calls it.
+func (c *Client) shutdown() {
+	c.Close(CloseNormal, "")
+	c.conn.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(config.WriteWait))
+	c.conn.Close()
+}
+
+// WritePump writes queued frames and pings the peer until the client is
+// unregistered or closed, then closes the connection.
+func (c *Client) WritePump() {
+	ticker := time.NewTicker(config.PingInterval)
+	defer ticker.Stop()
+	defer c.shutdown()
+	for {
+		select {
+		case <-c.closing:
+			return
+		case frame, ok := <-c.send:
+			if !ok {
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				c.abort(err)
+				return
+			}
+			framesSent.Add(1)
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.abort(err)
+				return
+			}
+		}
+	}
+}
+
+// abort closes a connection that failed to write. Frames queued until the
+// client is unregistered can't be delivered anymore.
+func (c *Client) abort(err error) {
+	log.Println(err)
+	c.conn.Close()
+	for range c.send {
+		framesDropped.Add(1)
+	}
+}
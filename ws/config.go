@@ -0,0 +1,41 @@
+package ws
+
+import (
+	"errors"
+	"time"
+)
+
+// Config holds the keepalive timings of WebSocket connections.
+type Config struct {
+	// PingInterval is how often the server pings a connection.
+	PingInterval time.Duration
+	// PongWait is how long the server waits for any frame, pongs included,
+	// before it considers the connection dead. It must exceed PingInterval.
+	PongWait time.Duration
+	// WriteWait is the time allowed to write a frame to the peer.
+	WriteWait time.Duration
+}
+
+var config = Config{
+	PingInterval: 50 * time.Second,
+	PongWait:     60 * time.Second,
+	WriteWait:    10 * time.Second,
+}
+
+// Configure replaces the default timings. Zero fields keep their defaults.
+func Configure(cfg Config) error {
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = config.PingInterval
+	}
+	if cfg.PongWait == 0 {
+		cfg.PongWait = config.PongWait
+	}
+	if cfg.WriteWait == 0 {
+		cfg.WriteWait = config.WriteWait
+	}
+	if cfg.PingInterval >= cfg.PongWait {
+		return errors.New("ws: ping interval must be shorter than pong wait")
+	}
+	config = cfg
+	return nil
+}
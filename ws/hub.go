@@ -0,0 +1,140 @@
+package ws
+
+import (
+	"log"
+	"sync"
+)
+
+// Hub keeps the open connections of every user so events reach all of
+// their tabs and devices.
+var Hub = &hub{
+	clients: make(map[int]map[*Client]struct{}),
+}
+
+type hub struct {
+	mux     sync.RWMutex
+	clients map[int]map[*Client]struct{}
+}
+
+// Register adds a client. It reports whether it is the first connection of
+// the user.
+func (h *hub) Register(client *Client) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	conns, ok := h.clients[client.UserId]
+	if !ok {
+		conns = make(map[*Client]struct{})
+		h.clients[client.UserId] = conns
+	}
+	conns[client] = struct{}{}
+	return !ok
+}
+
+// Unregister removes a client and stops its writer. It reports whether it
+// was the last connection of the user.
+func (h *hub) Unregister(client *Client) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	conns, ok := h.clients[client.UserId]
+	if !ok {
+		return false
+	}
+	if _, ok := conns[client]; !ok {
+		return false
+	}
+	delete(conns, client)
+	client.closeSend()
+	if len(conns) == 0 {
+		delete(h.clients, client.UserId)
+		return true
+	}
+	return false
+}
+
+// Online reports whether the user has at least one open connection.
+func (h *hub) Online(userId int) bool {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.clients[userId]) != 0
+}
+
+// Disconnect closes every connection of the user.
+func (h *hub) Disconnect(userId int, code int, reason string) {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for client := range h.clients[userId] {
+		client.Close(code, reason)
+	}
+}
+
+// DisconnectSession closes the connections of the user that were opened
+// with tokens of the given session.
+func (h *hub) DisconnectSession(userId int, session string, code int, reason string) {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for client := range h.clients[userId] {
+		if client.Session == session {
+			client.Close(code, reason)
+		}
+	}
+}
+
+// DisconnectAPIKey closes the connections of the user that were opened with
+// the given API key.
+func (h *hub) DisconnectAPIKey(userId, keyId int, code int, reason string) {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for client := range h.clients[userId] {
+		if client.APIKeyId == keyId {
+			client.Close(code, reason)
+		}
+	}
+}
+
+// SendToUser queues an event on every connection of the user.
+func (h *hub) SendToUser(userId int, event Event) {
+	h.SendToUsers([]int{userId}, 0, event)
+}
+
+// SendToUsers queues an event on every connection of the given users except
+// skip.
+func (h *hub) SendToUsers(userIds []int, skip int, event Event) {
+	h.broadcast(userIds, skip, event, nil)
+}
+
+// SendToSubscribers queues an event on the connections of the given users
+// that subscribed to the room, except those of skip.
+func (h *hub) SendToSubscribers(roomId int, userIds []int, skip int, event Event) {
+	h.broadcast(userIds, skip, event, func(client *Client) bool {
+		return client.Subscribed(roomId)
+	})
+}
+
+// broadcast encodes the event once per protocol version and queues it on the
+// connections accepted by filter, or all of them when filter is nil.
+func (h *hub) broadcast(userIds []int, skip int, event Event, filter func(*Client) bool) {
+	frames := make(map[int][]byte)
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	for _, userId := range userIds {
+		if userId == skip {
+			continue
+		}
+		for client := range h.clients[userId] {
+			if filter != nil && !filter(client) {
+				continue
+			}
+			frame, ok := frames[client.version]
+			if !ok {
+				var err error
+				frame, err = encode(event, client.version)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				frames[client.version] = frame
+			}
+			client.Send(frame)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package ws
+
+import (
+	"expvar"
+)
+
+// Counters of outbound frames, published with the other expvar variables.
+var (
+	framesSent      = expvar.NewInt("ws_frames_sent")
+	framesDropped   = expvar.NewInt("ws_frames_dropped")
+	slowDisconnects = expvar.NewInt("ws_slow_disconnects")
+)
@@ -0,0 +1,138 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// Subprotocol is requested by clients that speak the envelope protocol.
+// Connections without it get the flat frames of the original protocol,
+// where every pushed object carries its own "type" field, and their inbound
+// frames are echoed.
+const Subprotocol = "social-media.v1"
+
+// ProtocolVersion is carried in the v field of every envelope.
+const ProtocolVersion = 1
+
+// Envelope is a frame of the protocol in both directions. Id is chosen by
+// the client for commands and echoed in the ack or error that answers them.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Event is pushed by the server. Payload is what clients of the original
+// protocol receive as-is.
+type Event struct {
+	Type    string
+	Payload interface{}
+}
+
+// Frame types sent by the server in reply to commands.
+const (
+	TypeAck   = "ack"
+	TypeError = "error"
+)
+
+// Error codes carried by error frames.
+const (
+	ErrBadRequest  = "bad_request"
+	ErrVersion     = "unsupported_version"
+	ErrUnknownType = "unknown_type"
+	ErrForbidden   = "forbidden"
+	ErrNotFound    = "not_found"
+	ErrInternal    = "internal"
+)
+
+// Error is returned by command handlers to answer with an error frame.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// CommandHandler handles one command type. The returned value becomes the
+// payload of the ack; a nil value with a nil error sends no ack.
+type CommandHandler func(client *Client, payload json.RawMessage) (interface{}, error)
+
+var (
+	handlersMux sync.RWMutex
+	handlers    = make(map[string]CommandHandler)
+)
+
+// Handle registers the handler of a command type.
+func Handle(commandType string, handler CommandHandler) {
+	handlersMux.Lock()
+	defer handlersMux.Unlock()
+	handlers[commandType] = handler
+}
+
+func dispatch(client *Client, frame []byte) {
+	var env Envelope
+	if err := json.Unmarshal(frame, &env); err != nil || env.Type == "" {
+		client.reply(TypeError, "", NewError(ErrBadRequest, "malformed envelope"))
+		return
+	}
+	if env.V != ProtocolVersion {
+		client.reply(TypeError, env.Id, NewError(ErrVersion, "unsupported protocol version"))
+		return
+	}
+
+	handlersMux.RLock()
+	handler, ok := handlers[env.Type]
+	handlersMux.RUnlock()
+	if !ok {
+		client.reply(TypeError, env.Id, NewError(ErrUnknownType, "unknown type "+env.Type))
+		return
+	}
+
+	res, err := handler(client, env.Payload)
+	if err != nil {
+		protoErr, ok := err.(*Error)
+		if !ok {
+			log.Println(err)
+			protoErr = NewError(ErrInternal, "internal error")
+		}
+		client.reply(TypeError, env.Id, protoErr)
+		return
+	}
+	if res != nil {
+		client.reply(TypeAck, env.Id, res)
+	}
+}
+
+// encode returns the frame of an event for a protocol version.
+func encode(event Event, version int) ([]byte, error) {
+	if version == 0 {
+		return json.Marshal(event.Payload)
+	}
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{V: ProtocolVersion, Type: event.Type, Payload: payload})
+}
+
+func (c *Client) reply(frameType, id string, payload interface{}) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	frame, err := json.Marshal(Envelope{V: ProtocolVersion, Type: frameType, Id: id, Payload: raw})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.Send(frame)
+}
@@ -1,24 +1,42 @@
 package ws
 
 import (
-	"fmt"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func WSHandler(conn *websocket.Conn) {
+// WSHandler reads frames from the client until the connection is closed or
+// the peer stops answering pings. Envelopes are dispatched to the registered
+// command handlers; clients of the original protocol get their frames echoed.
+// Replies go through the client's send queue so they never race with other
+// writes.
+func WSHandler(client *Client) {
+	conn := client.conn
+	conn.SetReadLimit(maxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	})
+
 	for {
-		messageType, p, err := conn.ReadMessage()
+		_, p, err := conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println(err)
+			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				client.Close(CloseFrameLimit, "frame too large")
+			}
 			return
 		}
-		fmt.Println(string(p))
-		err = conn.WriteMessage(messageType, p)
-		if err != nil {
-			log.Println(err)
-			return
+		conn.SetReadDeadline(time.Now().Add(config.PongWait))
+		if client.version == 0 {
+			client.Send(p)
+			continue
 		}
+		dispatch(client, p)
 	}
 }